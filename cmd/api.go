@@ -8,12 +8,116 @@ import (
 	"fmt"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"io"
 	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
 type PluginUpdateRequest struct {
 	Node   string `json:"node"`
 	Plugin string `json:"plugin"`
+	// Kind of the artifact: plugin (default) or local
+	Kind string `json:"kind"`
+}
+
+// parseAuditFilter Return the audit filter from the query, since and until are RFC3339 times
+func parseAuditFilter(context *gin.Context) (utils.AuditFilter, error) {
+	filter := utils.AuditFilter{
+		Actor:  context.Query("actor"),
+		Action: context.Query("action"),
+		Host:   context.Query("host"),
+		Name:   context.Query("name"),
+	}
+	var err error
+	if since := context.Query("since"); since != "" {
+		filter.Since, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			return filter, fmt.Errorf("bad since: %s", err)
+		}
+	}
+	if until := context.Query("until"); until != "" {
+		filter.Until, err = time.Parse(time.RFC3339, until)
+		if err != nil {
+			return filter, fmt.Errorf("bad until: %s", err)
+		}
+	}
+	return filter, nil
+}
+
+// rollbackArtifactHandler Restore the previous version of the plugin or local check on the node
+func rollbackArtifactHandler(kind string) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		node, ok := utils.CheckMkNodeMap.GetAvailableNode(context.Param("host"))
+		if !ok {
+			context.JSON(404, gin.H{
+				"error": "Node not found",
+			})
+			return
+		}
+		artifact := node.FindArtifact(kind, context.Param("name"))
+		err := node.RollbackPlugin(artifact)
+		utils.Audit.Add(utils.AuditEntry{
+			Actor:     log.RequestActor(context),
+			Action:    utils.AuditRollback,
+			Host:      node.Host,
+			Kind:      kind,
+			Name:      artifact.Name,
+			OldSha256: artifact.NodeSha256,
+		}.WithError(err))
+		if err != nil {
+			context.JSON(500, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		// Send update plugin trigger to channel
+		utils.TriggerPluginChecker()
+
+		context.JSON(200, gin.H{
+			"message": "Plugin rolled back",
+		})
+	}
+}
+
+// removeArtifactHandler Remove the plugin or local check from the node
+func removeArtifactHandler(kind string) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		node, ok := utils.CheckMkNodeMap.GetAvailableNode(context.Param("host"))
+		if !ok {
+			context.JSON(404, gin.H{
+				"error": "Node not found",
+			})
+			return
+		}
+		artifact := node.FindArtifact(kind, context.Param("name"))
+		err := node.RemovePlugin(artifact)
+		utils.Audit.Add(utils.AuditEntry{
+			Actor:     log.RequestActor(context),
+			Action:    utils.AuditRemove,
+			Host:      node.Host,
+			Kind:      kind,
+			Name:      artifact.Name,
+			OldSha256: artifact.NodeSha256,
+		}.WithError(err))
+		if err != nil {
+			context.JSON(500, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		// Artifact is not expected on the node anymore
+		utils.CheckMkNodeMap.RemoveNodePlugin(node.Host, artifact)
+
+		// Send update plugin trigger to channel
+		utils.TriggerPluginChecker()
+
+		context.JSON(200, gin.H{
+			"message": "Plugin removed",
+		})
+	}
 }
 
 func RunAPI() {
@@ -35,8 +139,11 @@ func RunAPI() {
 	// example: /public/assets/images/*
 	r.StaticFS("/assets", mustFS())
 
-	// Create /api endpoint
+	// Create /api endpoint, authenticated with basic auth if api_users are set
 	api := r.Group("/api")
+	if len(config.ConfigCmkGetter.ApiUsers) > 0 {
+		api.Use(gin.BasicAuth(config.ConfigCmkGetter.ApiUsers))
+	}
 
 	// Serve index.html on all other routes
 	r.NoRoute(func(c *gin.Context) {
@@ -57,6 +164,124 @@ func RunAPI() {
 		)
 	})
 
+	// Liveness of the service, fails if a background goroutine is stalled
+	r.GET("/healthz", func(context *gin.Context) {
+		report := utils.HealthCheck()
+		code := http.StatusOK
+		if !report.IsOk() {
+			code = http.StatusServiceUnavailable
+		}
+		context.JSON(code, report)
+	})
+
+	// Readiness of the service, fails also if Check_MK is not reachable or a folder is not writable
+	r.GET("/readyz", func(context *gin.Context) {
+		report := utils.ReadyCheck()
+		code := http.StatusOK
+		if !report.IsOk() {
+			code = http.StatusServiceUnavailable
+		}
+		context.JSON(code, report)
+	})
+
+	// Self-monitoring in the Check_MK local check format
+	// Read-only like /healthz, so it is not authenticated and the agent plugin needs no credentials
+	r.GET("/api/local-check", func(context *gin.Context) {
+		context.String(200, utils.SelfCheckOutput(utils.CheckMkNodeMap.List()))
+	})
+
+	// API endpoint with the log of the webhook deliveries
+	api.GET("/notifications/deliveries", func(context *gin.Context) {
+		context.JSON(200, utils.Notifier.Deliveries())
+	})
+
+	// API endpoint to send the test notification to all webhooks
+	api.POST("/notifications/test", func(context *gin.Context) {
+		deliveries := utils.Notifier.Notify(utils.Notification{
+			Event: utils.NotifyTest,
+			Time:  time.Now(),
+			Title: "Test notification",
+			Text:  "Test notification from cmk_getter",
+		})
+		context.JSON(200, deliveries)
+	})
+
+	// API endpoint with the preview of the daily digest as HTML
+	api.GET("/digest/preview", func(context *gin.Context) {
+		html, err := utils.RenderDigest(utils.CurrentDigest())
+		if err != nil {
+			context.JSON(500, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		context.Data(200, "text/html; charset=utf-8", []byte(html))
+	})
+
+	// API endpoint to send the daily digest now
+	api.POST("/digest/send", func(context *gin.Context) {
+		err := utils.SendDigest()
+		if err != nil {
+			context.JSON(500, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		context.JSON(200, gin.H{
+			"message": "Digest sent",
+		})
+	})
+
+	// API endpoint with the audit log of the mutating actions, the oldest first
+	// Filtered by ?actor, ?action, ?host, ?name, ?since and ?until, exported with ?format=csv or ?format=jsonl
+	api.GET("/audit", func(context *gin.Context) {
+		filter, err := parseAuditFilter(context)
+		if err != nil {
+			context.JSON(400, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		entries, err := utils.Audit.Query(filter)
+		if err != nil {
+			context.JSON(500, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		switch context.Query("format") {
+		case "", "json":
+			context.JSON(200, entries)
+		case "csv":
+			context.Header("Content-Disposition", "attachment; filename=audit.csv")
+			context.Header("Content-Type", "text/csv; charset=utf-8")
+			context.Status(200)
+			err = utils.WriteAuditCsv(context.Writer, entries)
+		case "jsonl":
+			context.Header("Content-Disposition", "attachment; filename=audit.jsonl")
+			context.Header("Content-Type", "application/x-ndjson")
+			context.Status(200)
+			err = utils.WriteAuditJsonLines(context.Writer, entries)
+		default:
+			context.JSON(400, gin.H{
+				"error": "Unknown format",
+			})
+			return
+		}
+		if err != nil {
+			log.Logger.Errorln("Error writing audit export:", err)
+		}
+	})
+
+	// Metrics in the Prometheus text format
+	r.GET("/metrics", func(context *gin.Context) {
+		context.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		err := utils.Metrics.WriteMetrics(context.Writer, utils.CheckMkNodeMap.List())
+		if err != nil {
+			log.Logger.Debugln("Error writing metrics:", err)
+		}
+	})
+
 	// JSON endpoint with folders and files saved from Check_MK
 	api.GET("/cmk-files", func(context *gin.Context) {
 		// Get files from folders and return JSON
@@ -66,78 +291,100 @@ func RunAPI() {
 		folders := config.ConfigCmkGetter.Folders
 
 		for _, folder := range folders {
-			files, err := utils.GetFiles(folder)
+			folderFiles, err := utils.GetFolderFiles(folder)
 			if err != nil {
 				context.JSON(500, gin.H{
 					"error": err,
 				})
 				return
 			}
-			folderFiles := []File{}
-			for _, file := range files {
-				md5, err := utils.GetMD5(folder + "/" + file)
-				if err != nil {
-					context.JSON(500, gin.H{
-						"error": err,
-					})
-					return
-				}
-				size, err := utils.GetFileSize(folder + "/" + file)
-				if err != nil {
-					context.JSON(500, gin.H{
-						"error": err,
-					})
-					return
-				}
-				folderFiles = append(folderFiles, File{
-					Name: file,
-					MD5:  md5,
-					Date: utils.GetDate(folder + "/" + file),
-					SIze: size,
-				})
-			}
 			FoldersResp.Folders = append(FoldersResp.Folders, Folder{Name: folder, Files: folderFiles})
 		}
 
 		context.JSON(200, FoldersResp)
 	})
 
+	// Download file from the configured folder with the checksum headers
+	api.GET("/cmk-files/download", func(context *gin.Context) {
+		folder := context.Query("folder")
+		isConfigured := false
+		for _, configured := range config.ConfigCmkGetter.Folders {
+			if configured == folder {
+				isConfigured = true
+			}
+		}
+		// Only files directly in the configured folders can be downloaded
+		file := filepath.Base(context.Query("file"))
+		if !isConfigured || file == "." || file == "/" {
+			context.JSON(404, gin.H{
+				"error": "File not found",
+			})
+			return
+		}
+		filePath := filepath.Join(folder, file)
+		headers, err := utils.ChecksumHeaders(filePath)
+		if err != nil {
+			context.JSON(404, gin.H{
+				"error": "File not found",
+			})
+			return
+		}
+		for name, value := range headers {
+			context.Header(name, value)
+		}
+		context.FileAttachment(filePath, file)
+	})
+
+	// Plugins available on the Check_MK server with the states on the nodes
+	api.GET("/plugins", func(context *gin.Context) {
+		utils.Catalog.Mutex.Lock()
+		updatedAt := utils.Catalog.UpdatedAt
+		catalogError := utils.Catalog.Error
+		utils.Catalog.Mutex.Unlock()
+		context.JSON(200, gin.H{
+			"plugins":    utils.Catalog.List(),
+			"updated_at": updatedAt,
+			"error":      catalogError,
+		})
+	})
+
+	// Refresh the plugin catalog from the Check_MK server
+	api.POST("/plugins/refresh", func(context *gin.Context) {
+		err := utils.RefreshCatalog()
+		if err != nil {
+			context.JSON(500, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		context.JSON(200, gin.H{
+			"message": "Plugin catalog refreshed",
+		})
+	})
+
 	// API endpoint to trigger deploy plugin to node
 	api.POST("/deploy-plugin", func(context *gin.Context) {
 		// Get node name and plugin name from request
 		var req PluginUpdateRequest
 		if err := context.ShouldBind(&req); err == nil {
-			// Iterate over nodes and find node with name and IsAvailable = true
-			node := utils.CheckMkNode{}
-			for _, n := range utils.CheckMkNodeMap.Nodes {
-				log.Logger.Debug("Node: ", n.Host)
-				if n.Host == req.Node && n.IsAvailable {
-					node = n
-				}
-			}
 			// If node not found return error
-			if node.Host == "" {
-				context.JSON(500, gin.H{
+			if _, ok := utils.CheckMkNodeMap.GetAvailableNode(req.Node); !ok {
+				context.JSON(404, gin.H{
 					"error": "Node not found",
 				})
 				return
 			}
-			// Deploy plugin to node via SendPlugin
-			err := node.SendPlugin(utils.CheckMkPlugin{
-				Name: req.Plugin,
-			})
+			// Deploy plugin to node in the job, the status is polled by the job id
+			job, err := utils.Jobs.SubmitAs(log.RequestActor(context), utils.JobDeployPlugin, utils.DeployPluginJob(req.Node, req.Kind, req.Plugin))
 			if err != nil {
-				context.JSON(500, gin.H{
-					"error": err,
+				context.JSON(503, gin.H{
+					"error": err.Error(),
 				})
 				return
 			}
-
-			// Send update plugin trigger to channel
-			utils.PluginCheckerTrigger <- true
-
-			context.JSON(200, gin.H{
-				"message": "Plugin deployed",
+			context.JSON(202, gin.H{
+				"message": "Plugin deploy queued",
+				"job_id":  job.Id,
 			})
 			return
 		}
@@ -146,10 +393,222 @@ func RunAPI() {
 		})
 	})
 
+	// API endpoint to deploy plugins to the nodes selected by list, label, folder or drift
+	api.POST("/bulk-deploy", func(context *gin.Context) {
+		var req utils.BulkDeployRequest
+		if err := context.ShouldBindJSON(&req); err != nil {
+			context.JSON(400, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		plan, err := utils.PlanBulkDeploy(utils.CheckMkNodeMap.List(), req)
+		if err != nil {
+			context.JSON(400, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		job, err := utils.Jobs.SubmitAs(log.RequestActor(context), utils.JobBulkDeploy, utils.BulkDeployJob(plan, req.Kind, req.GetBulkConcurrency()))
+		if err != nil {
+			context.JSON(503, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		context.JSON(202, gin.H{
+			"message": "Bulk deploy queued",
+			"job_id":  job.Id,
+			"plan":    plan,
+		})
+	})
+
+	// API endpoint to stream the events, ?types=node,plugin selects the event types
+	api.GET("/events", func(context *gin.Context) {
+		types := make(map[string]bool)
+		for _, eventType := range strings.Split(context.Query("types"), ",") {
+			if eventType != "" {
+				types[eventType] = true
+			}
+		}
+		events := utils.Events.Subscribe()
+		defer utils.Events.Unsubscribe(events)
+		// Comments keep the connection open through proxies
+		heartbeat := time.NewTicker(30 * time.Second)
+		defer heartbeat.Stop()
+		context.Header("Cache-Control", "no-cache")
+		context.Header("X-Accel-Buffering", "no")
+		context.Stream(func(w io.Writer) bool {
+			select {
+			case event := <-events:
+				if len(types) == 0 || types[event.Type] {
+					context.SSEvent(event.Type, event)
+				}
+				return true
+			case <-heartbeat.C:
+				_, err := io.WriteString(w, ": heartbeat\n\n")
+				return err == nil
+			case <-context.Request.Context().Done():
+				return false
+			}
+		})
+	})
+
+	// API endpoint to list the jobs
+	api.GET("/jobs", func(context *gin.Context) {
+		context.JSON(200, utils.Jobs.List())
+	})
+
+	// API endpoint to get the job state, steps and result
+	api.GET("/jobs/:id", func(context *gin.Context) {
+		job, ok := utils.Jobs.Get(context.Param("id"))
+		if !ok {
+			context.JSON(404, gin.H{
+				"error": "Job not found",
+			})
+			return
+		}
+		context.JSON(200, job)
+	})
+
+	// API endpoint to cancel the queued or running job
+	api.POST("/jobs/:id/cancel", func(context *gin.Context) {
+		err := utils.Jobs.Cancel(context.Param("id"))
+		if err != nil {
+			context.JSON(400, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		context.JSON(200, gin.H{
+			"message": "Job cancelled",
+		})
+	})
+
+	// API endpoints to remove plugin or local check from node
+	api.DELETE("/nodes/:host/plugins/:name", removeArtifactHandler(utils.KindPlugin))
+	api.DELETE("/nodes/:host/local/:name", removeArtifactHandler(utils.KindLocal))
+
+	// API endpoints to restore the previous version of plugin or local check on node
+	api.POST("/nodes/:host/plugins/:name/rollback", rollbackArtifactHandler(utils.KindPlugin))
+	api.POST("/nodes/:host/local/:name/rollback", rollbackArtifactHandler(utils.KindLocal))
+
+	// API endpoint to install or upgrade the agent package on node
+	api.POST("/nodes/:host/agent/install", func(context *gin.Context) {
+		node, ok := utils.CheckMkNodeMap.GetAvailableNode(context.Param("host"))
+		if !ok {
+			context.JSON(404, gin.H{
+				"error": "Node not found",
+			})
+			return
+		}
+		result := node.InstallAgent()
+		utils.Audit.Add(utils.AgentInstallEntry(log.RequestActor(context), node.Host, result))
+		if !result.Success {
+			context.JSON(500, result)
+			return
+		}
+		context.JSON(200, result)
+	})
+
+	// API endpoint to run the agent on node and return the parsed output
+	// Sections can be filtered with ?section=name
+	api.GET("/nodes/:host/agent-output", func(context *gin.Context) {
+		node, ok := utils.CheckMkNodeMap.GetAvailableNode(context.Param("host"))
+		if !ok {
+			context.JSON(404, gin.H{
+				"error": "Node not found",
+			})
+			return
+		}
+		output, err := node.CollectAgentOutput()
+		if err != nil {
+			context.JSON(500, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		if names := context.QueryArray("section"); len(names) > 0 {
+			sections := []utils.AgentSection{}
+			for _, name := range names {
+				if section, ok := output.GetSection(name); ok {
+					sections = append(sections, section)
+				}
+			}
+			output.Sections = sections
+		}
+		context.JSON(200, output)
+	})
+
+	// Staged agent rollouts
+	api.GET("/rollouts", func(context *gin.Context) {
+		context.JSON(200, utils.Rollouts.List())
+	})
+
+	api.GET("/rollouts/:id", func(context *gin.Context) {
+		rollout, ok := utils.Rollouts.Get(context.Param("id"))
+		if !ok {
+			context.JSON(404, gin.H{
+				"error": "Rollout not found",
+			})
+			return
+		}
+		context.JSON(200, rollout)
+	})
+
+	api.POST("/rollouts", func(context *gin.Context) {
+		var req utils.RolloutRequest
+		if err := context.ShouldBindJSON(&req); err != nil {
+			context.JSON(400, gin.H{
+				"error": "Bad request",
+			})
+			return
+		}
+		req.Actor = log.RequestActor(context)
+		rollout, err := utils.CreateRollout(req)
+		if err != nil {
+			context.JSON(400, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		context.JSON(200, rollout)
+	})
+
+	api.POST("/rollouts/:id/pause", func(context *gin.Context) {
+		err := utils.PauseRollout(context.Param("id"))
+		if err != nil {
+			context.JSON(400, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		context.JSON(200, gin.H{
+			"message": "Rollout will be paused after the current wave",
+		})
+	})
+
+	api.POST("/rollouts/:id/resume", func(context *gin.Context) {
+		err := utils.ResumeRollout(context.Param("id"))
+		if err != nil {
+			context.JSON(400, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		context.JSON(200, gin.H{
+			"message": "Rollout resumed",
+		})
+	})
+
 	// JSON with ssh nodes
 	api.GET("/ssh-nodes", func(context *gin.Context) {
-		// Get nodes from CMK API
-		context.JSON(200, utils.CheckMkNodeMap.Nodes)
+		// Copy the nodes under the lock, the map is changed by the other goroutines
+		nodes := make(map[string]utils.CheckMkNode)
+		for _, node := range utils.CheckMkNodeMap.List() {
+			nodes[node.Host] = node
+		}
+		context.JSON(200, nodes)
 	})
 
 	// Start server
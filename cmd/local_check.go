@@ -0,0 +1,50 @@
+package main
+
+import (
+	"cmk_getter/config"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// localCheckTimeout Timeout of the request to the running cmk_getter
+const localCheckTimeout = 10 * time.Second
+
+// localCheckUrl Return the url of the local check endpoint of the running cmk_getter
+func localCheckUrl() string {
+	host := config.ConfigCmkGetter.Listen
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return fmt.Sprintf("http://%s:%d/api/local-check", host, config.ConfigCmkGetter.Port)
+}
+
+// LocalCheck Print the self-monitoring output of the running cmk_getter
+// The url of the endpoint can be set as the first argument
+// If cmk_getter is not reachable the service is printed as CRIT
+func LocalCheck(args []string) int {
+	url := localCheckUrl()
+	if len(args) > 0 {
+		url = args[0]
+	}
+	client := &http.Client{Timeout: localCheckTimeout}
+	resp, err := client.Get(url)
+	if err == nil && resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		err = fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	if err != nil {
+		fmt.Printf("<<<local:sep(0)>>>\n2 \"cmk_getter\" - cmk_getter is not reachable: %s\n", err)
+		return 0
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	_, err = io.Copy(os.Stdout, resp.Body)
+	if err != nil {
+		return 1
+	}
+	return 0
+}
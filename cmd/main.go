@@ -3,22 +3,17 @@ package main
 import (
 	assets "cmk_getter"
 	"cmk_getter/config"
+	"cmk_getter/log"
 	"cmk_getter/utils"
 	"io/fs"
 	"net/http"
+	"os"
 	"time"
 )
 
-type File struct {
-	Name string `json:"name"`
-	MD5  string `json:"md5"`
-	Date string `json:"date"`
-	SIze int64  `json:"size"`
-}
-
 type Folder struct {
-	Name  string `json:"name"`
-	Files []File `json:"files"`
+	Name  string          `json:"name"`
+	Files []utils.CmkFile `json:"files"`
 }
 
 type FoldersResponse struct {
@@ -27,6 +22,12 @@ type FoldersResponse struct {
 }
 
 func Run() {
+	// Get the current version of check_mk before the goroutines use it
+	err := utils.InitCurrentVersion()
+	if err != nil {
+		log.Logger.Fatalln(err)
+	}
+
 	// Create channel for goroutines
 	channel := make(chan utils.CmkVersionChanges)
 
@@ -35,6 +36,17 @@ func Run() {
 	duration := time.Duration(config.ConfigCmkGetter.Polling) * time.Second
 	ticker := time.NewTicker(duration)
 
+	// Expected intervals of the goroutines for the stall detection
+	utils.Health.Register(utils.SubsystemVersionChecker, duration)
+	utils.Health.Register(utils.SubsystemNodeRefresher, 5*time.Minute)
+	utils.Health.Register(utils.SubsystemSSHUpdater, time.Minute)
+	utils.Health.Register(utils.SubsystemPluginChecker, 5*time.Minute)
+
+	// Save the config changes since the last start before the goroutines act on the config
+	utils.AuditConfigChanges()
+	// Load the history before the goroutines add entries to it
+	utils.LoadHistory()
+
 	// Run goroutines
 	go utils.CmkVersionChecker(ticker, channel)
 	go utils.CmkVersionHandler(channel)
@@ -42,6 +54,15 @@ func Run() {
 	go utils.SSHStatusUpdater()
 	go utils.CheckPlugins()
 	go utils.PluginCheckerTicker()
+	go utils.ResumeRollouts()
+	go utils.WatchFolders()
+	go utils.CatalogTicker()
+	utils.JobWorkers()
+	go utils.SystemdNotify()
+	go utils.Notifications()
+	go utils.HistoryRecorder()
+	go utils.HistorySaver()
+	go utils.DigestTicker()
 }
 
 func mustFS() http.FileSystem {
@@ -55,6 +76,10 @@ func mustFS() http.FileSystem {
 }
 
 func main() {
+	// Print the self-monitoring of the running cmk_getter for the Check_MK agent
+	if len(os.Args) > 1 && os.Args[1] == "local-check" {
+		os.Exit(LocalCheck(os.Args[2:]))
+	}
 	Run()
 	// Run API
 	RunAPI()
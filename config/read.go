@@ -23,25 +23,129 @@ func (c *Config) New() (*Config, error) {
 
 type Config struct {
 	// Config struct for config file
-	Listen      string   `yaml:"listen"`
-	Port        int      `yaml:"port"`
-	Domain      string   `json:"domain" yaml:"domain"`
-	Site        string   `json:"site" yaml:"site"`
-	PathToIdRSA string   `json:"path_to_id_rsa" yaml:"path_to_id_rsa"`
-	Folders     []string `json:"folders" yaml:"folders"`
-	Username    string   `json:"username" yaml:"username"`
-	Password    string   `json:"password" yaml:"password"`
-	Polling     int      `json:"polling" yaml:"polling"`
-	Plugins     []string `json:"plugins" yaml:"plugins"`
-	LogLevel    string   `json:"log_level" yaml:"log_level"`
+	Listen      string         `yaml:"listen"`
+	Port        int            `yaml:"port"`
+	Domain      string         `json:"domain" yaml:"domain"`
+	Site        string         `json:"site" yaml:"site"`
+	PathToIdRSA string         `json:"path_to_id_rsa" yaml:"path_to_id_rsa"`
+	Folders     []string       `json:"folders" yaml:"folders"`
+	Username    string         `json:"username" yaml:"username"`
+	Password    string         `json:"password" yaml:"password"`
+	Polling     int            `json:"polling" yaml:"polling"`
+	Plugins     []PluginConfig `json:"plugins" yaml:"plugins"`
+	LogLevel    string         `json:"log_level" yaml:"log_level"`
+	// Format of the log: text (default), json or logfmt
+	LogFormat string `json:"log_format" yaml:"log_format"`
+	// Folder with patched plugins overriding the plugins from the Check_MK server
+	PluginsFolder string `json:"plugins_folder" yaml:"plugins_folder"`
+	// Git checkout with patched plugins, looked up after PluginsFolder
+	PluginsGitPath string `json:"plugins_git_path" yaml:"plugins_git_path"`
+	// Run git pull in PluginsGitPath before each plugin check
+	PluginsGitPull bool `json:"plugins_git_pull" yaml:"plugins_git_pull"`
+	// Local checks deployed to /usr/lib/check_mk_agent/local from LocalChecksFolder
+	LocalChecks       []PluginConfig `json:"local_checks" yaml:"local_checks"`
+	LocalChecksFolder string         `json:"local_checks_folder" yaml:"local_checks_folder"`
+	// Folder with check-mk-agent-latest packages for the agent installation, first of Folders by default
+	AgentPackageFolder string `json:"agent_package_folder" yaml:"agent_package_folder"`
+	// Folder for the state of cmk_getter, ./data by default
+	DataFolder string `json:"data_folder" yaml:"data_folder"`
+	// Timeout in seconds of the plugin run after the deploy, 60 by default
+	VerifyTimeout int `json:"verify_timeout" yaml:"verify_timeout"`
+	// Calculate hashes of the plugins with sha256sum on the nodes instead of reading them over SFTP
+	RemoteHash bool `json:"remote_hash" yaml:"remote_hash"`
+	// Owner of the plugin files on the node, root by default
+	PluginUid int `json:"plugin_uid" yaml:"plugin_uid"`
+	PluginGid int `json:"plugin_gid" yaml:"plugin_gid"`
+	// Save the replaced plugin as <name>.bak on the node in addition to the local backup
+	RemotePluginBackup bool `json:"remote_plugin_backup" yaml:"remote_plugin_backup"`
+	// Restore the previous plugin version if the verification after the deploy fails
+	AutoRollback bool `json:"auto_rollback" yaml:"auto_rollback"`
+	// Remove files in plugin folders which are not in the plugins list
+	RemoveUnmanagedPlugins bool `json:"remove_unmanaged_plugins" yaml:"remove_unmanaged_plugins"`
+	// Number of workers running the deploy jobs, 4 by default
+	JobWorkers int `json:"job_workers" yaml:"job_workers"`
+	// Send READY=1 and watchdog pings to systemd, for Type=notify units with WatchdogSec
+	SystemdNotify bool `json:"systemd_notify" yaml:"systemd_notify"`
+	// Users of the API with the passwords, the API requires basic auth if set
+	ApiUsers map[string]string `json:"api_users" yaml:"api_users"`
+	// Thresholds of the self-monitoring local check
+	SelfCheck SelfCheckConfig `json:"self_check" yaml:"self_check"`
+	// Webhooks notified about new agent versions, unreachable nodes, drift and failed deploys
+	Webhooks []WebhookConfig `json:"webhooks" yaml:"webhooks"`
+	// SMTP server for the daily digest
+	Smtp SmtpConfig `json:"smtp" yaml:"smtp"`
+}
+
+// SmtpConfig SMTP server and recipients of the daily digest
+type SmtpConfig struct {
+	Host string `json:"host" yaml:"host"`
+	// Port of the SMTP server, 25 by default, STARTTLS is used if supported
+	Port     int      `json:"port" yaml:"port"`
+	Username string   `json:"username" yaml:"username"`
+	Password string   `json:"password" yaml:"password"`
+	From     string   `json:"from" yaml:"from"`
+	To       []string `json:"to" yaml:"to"`
+	// Hour of the day in the local time when the digest is sent
+	DigestHour int `json:"digest_hour" yaml:"digest_hour"`
+}
+
+// WebhookConfig Webhook receiving the notifications
+type WebhookConfig struct {
+	Name string `json:"name" yaml:"name"`
+	Url  string `json:"url" yaml:"url"`
+	// Format of the payload: json (default), slack or mattermost
+	Format string `json:"format" yaml:"format"`
+	// Events sent to the webhook, all events if empty
+	Events []string `json:"events" yaml:"events"`
+	// Number of retries of the failed delivery, 3 by default, negative to disable
+	Retries int `json:"retries" yaml:"retries"`
+}
+
+// SelfCheckConfig Thresholds of the self-monitoring services, 0 for the default, negative to disable
+type SelfCheckConfig struct {
+	// Number of the nodes not available by SSH, 1 and 5 by default
+	UnreachableWarn int `json:"unreachable_warn" yaml:"unreachable_warn"`
+	UnreachableCrit int `json:"unreachable_crit" yaml:"unreachable_crit"`
+	// Number of the drifted and failing plugins, 1 and 10 by default
+	DriftedWarn int `json:"drifted_warn" yaml:"drifted_warn"`
+	DriftedCrit int `json:"drifted_crit" yaml:"drifted_crit"`
+	// Report the plugins of each node in the piggyback data of the node
+	Piggyback bool `json:"piggyback" yaml:"piggyback"`
 }
 
 func ReadConfig() (Config, error) {
 	// Read config file from config/config.yaml
+	// Silent, the missing config must not be printed to the output of the local-check subcommand
 	var config Config
-	err := configor.Load(&config, "config.yaml")
+	err := configor.New(&configor.Config{Silent: true}).Load(&config, "config.yaml")
 	if err != nil {
 		return config, err
 	}
 	return config, nil
 }
+
+// PluginConfig Plugin from the config file with optional execution interval
+// Interval in seconds places the plugin in plugins/<interval>/ for asynchronous execution
+type PluginConfig struct {
+	Name     string `json:"name" yaml:"name"`
+	Interval int    `json:"interval" yaml:"interval"`
+	// Section Expected <<<section>>> header in the plugin output, any header if empty
+	Section string `json:"section" yaml:"section"`
+	// Source upstream, local or url, local override or upstream if empty
+	Source string `json:"source" yaml:"source"`
+	// Url of the plugin for the url source
+	Url string `json:"url" yaml:"url"`
+	// Sha256 Pinned checksum of the plugin content
+	Sha256 string `json:"sha256" yaml:"sha256"`
+}
+
+// UnmarshalYAML Allow plugins to be set as plain names or as name/interval maps
+func (p *PluginConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	if err := unmarshal(&name); err == nil {
+		p.Name = name
+		return nil
+	}
+	type plain PluginConfig
+	return unmarshal((*plain)(p))
+}
@@ -9,46 +9,169 @@ import (
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+	"time"
 )
 
+// Formats of the log
+const (
+	FormatText   = "text"
+	FormatJson   = "json"
+	FormatLogfmt = "logfmt"
+)
+
+// Fields of the log entries
+const (
+	FieldNode    = "node"
+	FieldPlugin  = "plugin"
+	FieldVersion = "version"
+	FieldJob     = "job_id"
+)
+
+const timestampFormat = "2006-01-02 15:04:05"
+
 type LogrusFormatter struct {
 	logrus.TextFormatter
 	LevelDesc []string
 }
 
-const messageTemplate = "%s %s %s\n"
+const messageTemplate = "%s %s %s%s\n"
 
 // Formatter function for logrus
+// Fields are appended to the message as key=value sorted by key
 func (f *LogrusFormatter) Format(entry *logrus.Entry) ([]byte, error) {
 	// Format timestamp to RFC3339
-	f.TimestampFormat = "2006-01-02 15:04:05"
+	f.TimestampFormat = timestampFormat
+	keys := make([]string, 0, len(entry.Data))
+	for key := range entry.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var fields strings.Builder
+	for _, key := range keys {
+		value := fmt.Sprint(entry.Data[key])
+		if strings.ContainsAny(value, " \"=") {
+			value = fmt.Sprintf("%q", value)
+		}
+		fields.WriteString(" " + key + "=" + value)
+	}
 	// Return []byte from messageTemplate
-	return []byte(fmt.Sprintf(messageTemplate, entry.Time.Format(f.TimestampFormat), f.LevelDesc[entry.Level], entry.Message)), nil
+	return []byte(fmt.Sprintf(messageTemplate, entry.Time.Format(f.TimestampFormat), f.LevelDesc[entry.Level], entry.Message, fields.String())), nil
 }
 
 // Logger is a global logger
 var Logger = logrus.New()
 
-// SetLogLevel sets the log level
+// SetLogLevel sets the log level, info if empty
 func SetLogLevel(level string) {
+	if level == "" {
+		level = "info"
+	}
 	lvl, err := logrus.ParseLevel(level)
 	if err != nil {
 		Logger.Fatal(err)
 	}
 	Logger.SetLevel(lvl)
-	plainFormatter := new(LogrusFormatter)
-	plainFormatter.LevelDesc = []string{"PANC", "FATL", "ERRO", "WARN", "INFO", "DEBG"}
-	Logger.SetFormatter(plainFormatter)
+}
 
+// SetLogFormat sets the formatter: text (default), json or logfmt
+func SetLogFormat(format string) {
+	switch format {
+	case "", FormatText:
+		plainFormatter := new(LogrusFormatter)
+		plainFormatter.LevelDesc = []string{"PANC", "FATL", "ERRO", "WARN", "INFO", "DEBG", "TRAC"}
+		Logger.SetFormatter(plainFormatter)
+	case FormatJson:
+		Logger.SetFormatter(&logrus.JSONFormatter{TimestampFormat: time.RFC3339})
+	case FormatLogfmt:
+		Logger.SetFormatter(&logrus.TextFormatter{
+			DisableColors:   true,
+			FullTimestamp:   true,
+			TimestampFormat: time.RFC3339,
+		})
+	default:
+		Logger.Fatal("unknown log format ", format)
+	}
 }
 
 func init() {
-	// Set log level from config
+	// Set log level and format from config
+	SetLogFormat(config.ConfigCmkGetter.LogFormat)
 	SetLogLevel(config.ConfigCmkGetter.LogLevel)
 }
 
+// WithNode Return the log entry with the node field
+func WithNode(host string) *logrus.Entry {
+	return Logger.WithField(FieldNode, host)
+}
+
+// WithPlugin Return the log entry with the node and plugin fields
+func WithPlugin(host, plugin string) *logrus.Entry {
+	return Logger.WithFields(logrus.Fields{FieldNode: host, FieldPlugin: plugin})
+}
+
+// WithVersion Return the log entry with the agent version field
+func WithVersion(version string) *logrus.Entry {
+	return Logger.WithField(FieldVersion, version)
+}
+
+// WithJob Return the log entry with the job id field
+func WithJob(id string) *logrus.Entry {
+	return Logger.WithField(FieldJob, id)
+}
+
+// RequestUser Return the user authenticated by the basic auth middleware, empty without authentication
+// The Authorization header is not trusted without the middleware checking the password
+func RequestUser(c *gin.Context) string {
+	return c.GetString(gin.AuthUserKey)
+}
+
+// RequestActor Return the user of the request for the audit log
+// Without the basic auth middleware the password is not checked, so the name is marked as unverified
+// and the client IP is added
+func RequestActor(c *gin.Context) string {
+	if user := RequestUser(c); user != "" {
+		return user
+	}
+	if user, _, ok := c.Request.BasicAuth(); ok && user != "" {
+		return fmt.Sprintf("unverified:%s@%s", user, c.ClientIP())
+	}
+	return "anonymous@" + c.ClientIP()
+}
+
+// GinrusLogger Log the request after the handler with the status, latency and size of the response
 func GinrusLogger() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		Logger.Infoln("HTTP Request", c.Request.Method, c.Request.URL.Path, c.ClientIP())
+		start := time.Now()
+		path := c.Request.URL.Path
+		c.Next()
+		// Size is -1 if nothing is written
+		size := c.Writer.Size()
+		if size < 0 {
+			size = 0
+		}
+		entry := Logger.WithFields(logrus.Fields{
+			"method":    c.Request.Method,
+			"path":      path,
+			"status":    c.Writer.Status(),
+			"latency":   time.Since(start).String(),
+			"bytes":     size,
+			"client_ip": c.ClientIP(),
+		})
+		if user := RequestUser(c); user != "" {
+			entry = entry.WithField("user", user)
+		}
+		if len(c.Errors) > 0 {
+			entry = entry.WithField("error", c.Errors.String())
+		}
+		switch {
+		case c.Writer.Status() >= 500:
+			entry.Errorln("HTTP Request")
+		case c.Writer.Status() >= 400:
+			entry.Warnln("HTTP Request")
+		default:
+			entry.Infoln("HTTP Request")
+		}
 	}
 }
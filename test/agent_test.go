@@ -0,0 +1,162 @@
+package test
+
+import (
+	"cmk_getter/config"
+	"cmk_getter/utils"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNormalizeAgentVersion(t *testing.T) {
+	versions := map[string]string{
+		"2.1.0p14-1":   "2.1.0p14",
+		"2.1.0p14\n":   "2.1.0p14",
+		"2.2.0b1":      "2.2.0b1",
+		" 2.0.0p32-2 ": "2.0.0p32",
+	}
+	for version, expected := range versions {
+		if got := utils.NormalizeAgentVersion(version); got != expected {
+			t.Errorf("Expected %s, got %s", expected, got)
+		}
+	}
+}
+
+func TestHasSection(t *testing.T) {
+	output := "<<<check_mk>>>\nVersion: 2.1.0p14\n<<<mk_inventory:sep(59)>>>\nline\n"
+	cases := map[string]bool{
+		"check_mk":     true,
+		"mk_inventory": true,
+		"":             true,
+		"df":           false,
+	}
+	for section, expected := range cases {
+		if got := utils.HasSection(output, section); got != expected {
+			t.Errorf("Section %q: expected %v, got %v", section, expected, got)
+		}
+	}
+	if utils.HasSection("no headers", "") {
+		t.Errorf("Expected no section in output without headers")
+	}
+}
+
+func TestParseAgentOutput(t *testing.T) {
+	output := "<<<check_mk>>>\nVersion: 2.1.0p14\nAgentOS: linux\nHostname: node1\n" +
+		"<<<df>>>\n/dev/sda1 ext4 100 50 50 50% /\n" +
+		"<<<<piggy>>>>\n<<<df>>>\n/dev/sdb1 ext4 100 50 50 50% /\n<<<<>>>>\n" +
+		"<<<logwatch:sep(0)>>>\n"
+	parsed := utils.ParseAgentOutput(output)
+	if parsed.Version != "2.1.0p14" || parsed.OS != "linux" || parsed.Hostname != "node1" {
+		t.Errorf("Unexpected agent info: %+v", parsed)
+	}
+	if len(parsed.Sections) != 4 {
+		t.Fatalf("Expected 4 sections, got %d", len(parsed.Sections))
+	}
+	df, ok := parsed.GetSection("df")
+	if !ok || len(df.Lines) != 1 || df.Lines[0] != "/dev/sda1 ext4 100 50 50 50% /" {
+		t.Errorf("Unexpected df section: %+v", df)
+	}
+	if parsed.Sections[2].Piggyback != "piggy" {
+		t.Errorf("Expected piggyback section for piggy, got %+v", parsed.Sections[2])
+	}
+	logwatch, ok := parsed.GetSection("logwatch")
+	if !ok || logwatch.Options != "sep(0)" {
+		t.Errorf("Unexpected logwatch section: %+v", logwatch)
+	}
+}
+
+func TestParseTempDir(t *testing.T) {
+	cases := map[string]bool{
+		"/tmp/cmk_getter.AbC123\n": true,
+		"tmp/cmk_getter.AbC123":    false,
+		"/tmp/a b":                 false,
+		"/tmp/a';rm -rf /'":        false,
+		"":                         false,
+	}
+	for stdout, valid := range cases {
+		dir, err := utils.ParseTempDir(stdout)
+		if valid && (err != nil || dir != "/tmp/cmk_getter.AbC123") {
+			t.Errorf("Expected valid directory for %q, got %q %v", stdout, dir, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("Expected error for %q", stdout)
+		}
+	}
+}
+
+func TestPackageVersion(t *testing.T) {
+	cases := []struct {
+		format   string
+		name     string
+		expected string
+	}{
+		{utils.PackageDeb, "check-mk-agent_2.1.0p14-1_all.deb", "2.1.0p14"},
+		{utils.PackageDeb, "check-mk-agent_2.2.0b1-2_all.deb", "2.2.0b1"},
+		{utils.PackageDeb, "check-mk-agent-latest.deb", ""},
+		{utils.PackageDeb, "check-mk-agent-2.1.0p14-1.noarch.rpm", ""},
+		{utils.PackageRpm, "check-mk-agent-2.1.0p14-1.noarch.rpm", "2.1.0p14"},
+		{utils.PackageRpm, "check-mk-agent-latest.rpm", ""},
+		{"msi", "check_mk_agent.msi", ""},
+	}
+	for _, tc := range cases {
+		if got := utils.PackageVersion(tc.format, tc.name); got != tc.expected {
+			t.Errorf("Expected %q for %s, got %q", tc.expected, tc.name, got)
+		}
+	}
+}
+
+// TestLatestAgentPackages Packages of all formats are pinned if they have the same version
+func TestLatestAgentPackages(t *testing.T) {
+	dir := t.TempDir()
+	saved := config.ConfigCmkGetter.AgentPackageFolder
+	config.ConfigCmkGetter.AgentPackageFolder = dir
+	defer func() {
+		config.ConfigCmkGetter.AgentPackageFolder = saved
+	}()
+	if _, err := utils.LatestAgentPackages(); err == nil {
+		t.Errorf("Expected error without packages")
+	}
+
+	writeTestFile(t, filepath.Join(dir, "check-mk-agent_2.1.0p20-1_all.deb"), "deb agent")
+	writeTestFile(t, filepath.Join(dir, "check-mk-agent-2.1.0p14-1.noarch.rpm"), "old rpm agent")
+	writeTestFile(t, filepath.Join(dir, "check-mk-agent-2.1.0p20-1.noarch.rpm"), "rpm agent")
+	_ = os.Symlink("check-mk-agent_2.1.0p20-1_all.deb", filepath.Join(dir, "check-mk-agent-latest.deb"))
+	_ = os.Symlink("check-mk-agent-2.1.0p14-1.noarch.rpm", filepath.Join(dir, "check-mk-agent-latest.rpm"))
+	packages, err := utils.LatestAgentPackages()
+	if err != nil {
+		t.Fatalf("Error reading packages: %s", err)
+	}
+	if len(packages) != 1 || packages.Version() != "2.1.0p20" {
+		t.Errorf("Expected only the deb package, the rpm has another version, got %v", packages)
+	}
+
+	_ = os.Remove(filepath.Join(dir, "check-mk-agent-latest.rpm"))
+	_ = os.Symlink("check-mk-agent-2.1.0p20-1.noarch.rpm", filepath.Join(dir, "check-mk-agent-latest.rpm"))
+	packages, _ = utils.LatestAgentPackages()
+	rpm := packages[utils.PackageRpm]
+	if len(packages) != 2 || rpm.Version != "2.1.0p20" || rpm.Sha256 != utils.Sha256Hex([]byte("rpm agent")) {
+		t.Errorf("Expected deb and rpm packages of 2.1.0p20, got %v", packages)
+	}
+}
+
+func TestIsSameVersion(t *testing.T) {
+	dir := t.TempDir()
+	version := &utils.CmkVersionResponse{Edition: "cre"}
+	version.Versions.Checkmk = "2.1.0p14.cre"
+	writeTestFile(t, filepath.Join(dir, "check-mk-agent_2.1.0p14-1_all.deb"), "deb agent")
+	if same, err := version.IsSameVersion(dir); same || err != nil {
+		t.Errorf("Expected the rpm package missing, got %v: %v", same, err)
+	}
+	writeTestFile(t, filepath.Join(dir, "check-mk-agent-2.1.0p14-1.noarch.rpm"), "rpm agent")
+	if same, err := version.IsSameVersion(dir); !same || err != nil {
+		t.Errorf("Expected all packages downloaded, got %v: %v", same, err)
+	}
+	if err := utils.CreateSymlink(dir, version.CroppedVersion()); err != nil {
+		t.Fatalf("Error creating symlinks: %s", err)
+	}
+	for format, expected := range map[string]string{utils.PackageDeb: "deb agent", utils.PackageRpm: "rpm agent"} {
+		if content := readTestFile(t, filepath.Join(dir, "check-mk-agent-latest."+format)); content != expected {
+			t.Errorf("Expected the %s symlink to the package, got %q", format, content)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package test
+
+import (
+	"bytes"
+	"cmk_getter/config"
+	"cmk_getter/utils"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditLogQuery(t *testing.T) {
+	dataFolder := config.ConfigCmkGetter.DataFolder
+	config.ConfigCmkGetter.DataFolder = t.TempDir()
+	defer func() {
+		config.ConfigCmkGetter.DataFolder = dataFolder
+	}()
+
+	now := time.Date(2023, 5, 10, 8, 0, 0, 0, time.UTC)
+	audit := &utils.AuditLog{}
+	audit.Add(utils.AuditEntry{Time: now.Add(-2 * time.Hour), Actor: "admin", Action: utils.AuditDeploy, Host: "node1",
+		Name: "mk_apache", OldSha256: "aaa", NewSha256: "bbb", Result: utils.PluginDeployed})
+	audit.Add(utils.AuditEntry{Time: now.Add(-time.Hour), Action: utils.AuditRemoveUnmanaged, Host: "node2", Name: "old, plugin"}.WithError(nil))
+	audit.Add(utils.AuditEntry{Time: now, Action: utils.AuditAgentDownload, Version: "2.1.0p20"}.WithError(errors.New("timeout")))
+
+	all, err := audit.Query(utils.AuditFilter{})
+	if err != nil {
+		t.Fatalf("Error reading audit log: %s", err)
+	}
+	if len(all) != 3 || all[1].Actor != utils.AuditActorAuto || all[1].Kind != utils.KindPlugin || all[2].Result != "failed" {
+		t.Errorf("Expected 3 entries with the default actor and kind, got %v", all)
+	}
+
+	entries, _ := audit.Query(utils.AuditFilter{Actor: utils.AuditActorAuto, Since: now.Add(-90 * time.Minute), Until: now.Add(-time.Minute)})
+	if len(entries) != 1 || entries[0].Host != "node2" {
+		t.Errorf("Expected the unmanaged removal on node2, got %v", entries)
+	}
+	entries, _ = audit.Query(utils.AuditFilter{Action: utils.AuditDeploy, Host: "node1", Name: "mk_apache"})
+	if len(entries) != 1 || entries[0].OldSha256 != "aaa" || entries[0].NewSha256 != "bbb" {
+		t.Errorf("Expected the deploy with hashes, got %v", entries)
+	}
+
+	var csv bytes.Buffer
+	err = utils.WriteAuditCsv(&csv, all)
+	if err != nil {
+		t.Fatalf("Error writing csv: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(csv.String()), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[0], "time,actor,action") || !strings.Contains(lines[2], `"old, plugin"`) {
+		t.Errorf("Expected csv with header and quoted name, got:\n%s", csv.String())
+	}
+	var jsonLines bytes.Buffer
+	_ = utils.WriteAuditJsonLines(&jsonLines, all)
+	if strings.Count(jsonLines.String(), "\n") != 3 {
+		t.Errorf("Expected 3 json lines, got:\n%s", jsonLines.String())
+	}
+}
+
+func TestDiffConfig(t *testing.T) {
+	previous := utils.AuditConfig{Sha256: "old", Pins: map[string]string{"mk_apache": "a1", "mk_mysql": "m1"}}
+	if entries := utils.DiffConfig(utils.AuditConfig{}, previous); len(entries) != 0 {
+		t.Errorf("Expected no entries on the first start, got %v", entries)
+	}
+	if entries := utils.DiffConfig(previous, previous); len(entries) != 0 {
+		t.Errorf("Expected no entries for the same config, got %v", entries)
+	}
+	current := utils.AuditConfig{Sha256: "new", Pins: map[string]string{"mk_apache": "a2", "mk_redis": "r1"}}
+	entries := utils.DiffConfig(previous, current)
+	if len(entries) != 4 || entries[0].Action != utils.AuditConfigChange {
+		t.Fatalf("Expected config change and 3 pin changes, got %v", entries)
+	}
+	if entries[1].Name != "mk_apache" || entries[1].OldSha256 != "a1" || entries[1].NewSha256 != "a2" {
+		t.Errorf("Expected changed pin of mk_apache, got %v", entries[1])
+	}
+	if entries[2].Name != "mk_mysql" || entries[2].NewSha256 != "" || entries[3].Name != "mk_redis" || entries[3].OldSha256 != "" {
+		t.Errorf("Expected removed pin of mk_mysql and added pin of mk_redis, got %v", entries[2:])
+	}
+}
+
+func TestActorFromContext(t *testing.T) {
+	if actor := utils.ActorFromContext(context.Background()); actor != utils.AuditActorAuto {
+		t.Errorf("Expected %s, got %s", utils.AuditActorAuto, actor)
+	}
+	if actor := utils.ActorFromContext(utils.WithActor(context.Background(), "admin")); actor != "admin" {
+		t.Errorf("Expected admin, got %s", actor)
+	}
+}
@@ -0,0 +1,83 @@
+package test
+
+import (
+	"cmk_getter/utils"
+	"path/filepath"
+	"testing"
+)
+
+func TestSendAndRevertPlugin(t *testing.T) {
+	cases := []struct {
+		name string
+		// Content of the file on the node before the deploy, no file if empty
+		onNode string
+		// Backup left by an earlier deploy
+		staleBackup string
+		action      string
+		reverted    bool
+		// Content of the file on the node after the revert
+		afterRevert string
+	}{
+		{name: "replaced", onNode: "old", staleBackup: "ancient", action: utils.PluginReplaced, reverted: true, afterRevert: "old"},
+		{name: "created", staleBackup: "ancient", action: utils.PluginCreated, reverted: true, afterRevert: ""},
+		{name: "unchanged", onNode: "new", staleBackup: "ancient", action: utils.PluginUnchanged, reverted: false, afterRevert: "new"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			node := newTestNode(t)
+			client := newSftpClient(t)
+			c := newTestPlugin("mk_test", "new")
+			pluginPath := filepath.Join(node.PluginFolder, c.Name)
+			if tc.onNode != "" {
+				writeTestFile(t, pluginPath, tc.onNode)
+			}
+			if err := utils.SavePluginBackup(node.Host, c, []byte(tc.staleBackup)); err != nil {
+				t.Fatal(err)
+			}
+
+			sent, err := node.SendPluginFile(nil, client, c)
+			if err != nil {
+				t.Fatalf("Error sending plugin: %s", err)
+			}
+			if sent.Action != tc.action || sent.NewSha256 != c.Sha256 {
+				t.Errorf("Expected %s, got %v", tc.action, sent)
+			}
+			if content := readTestFile(t, pluginPath); content != "new" {
+				t.Errorf("Expected new plugin on the node, got %q", content)
+			}
+			if tc.action == utils.PluginReplaced && sent.OldSha256 != utils.Sha256Hex([]byte("old")) {
+				t.Errorf("Expected hash of the replaced file, got %s", sent.OldSha256)
+			}
+			backup, _ := utils.LoadPluginBackup(node.Host, c)
+			switch tc.action {
+			case utils.PluginReplaced:
+				if string(backup) != "old" {
+					t.Errorf("Expected backup of the replaced file, got %q", backup)
+				}
+			case utils.PluginCreated:
+				if backup != nil {
+					t.Errorf("Expected the stale backup removed, got %q", backup)
+				}
+			}
+
+			reverted, err := node.RevertPluginFile(client, c, sent)
+			if err != nil {
+				t.Fatalf("Error reverting plugin: %s", err)
+			}
+			if reverted != tc.reverted {
+				t.Errorf("Expected reverted %v, got %v", tc.reverted, reverted)
+			}
+			if content := readTestFile(t, pluginPath); content != tc.afterRevert {
+				t.Errorf("Expected %q on the node after the revert, got %q", tc.afterRevert, content)
+			}
+		})
+	}
+}
+
+func TestRestorePluginBackupWithoutBackup(t *testing.T) {
+	node := newTestNode(t)
+	client := newSftpClient(t)
+	if err := node.RestorePluginBackup(client, newTestPlugin("mk_test", "new")); err == nil {
+		t.Errorf("Expected error without backup")
+	}
+}
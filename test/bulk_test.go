@@ -0,0 +1,58 @@
+package test
+
+import (
+	"cmk_getter/utils"
+	"reflect"
+	"testing"
+)
+
+func TestPlanBulkDeploy(t *testing.T) {
+	plugins := func(statuses ...string) []utils.CheckMkPlugin {
+		var list []utils.CheckMkPlugin
+		for i, status := range statuses {
+			list = append(list, utils.CheckMkPlugin{Name: []string{"apache", "mysql"}[i], Status: status})
+		}
+		return list
+	}
+	nodes := []utils.CheckMkNode{
+		{Host: "web1", IsAvailable: true, Folder: "/linux/web", Labels: map[string]string{"env": "prod"},
+			Plugins: plugins(utils.PluginDeployed, utils.PluginDrifted)},
+		{Host: "web2", IsAvailable: true, Folder: "/linux/webserver", Labels: map[string]string{"env": "test"},
+			Plugins: plugins(utils.PluginDrifted, utils.PluginDrifted)},
+		{Host: "db1", IsAvailable: false, Folder: "/linux/web/db", Labels: map[string]string{"env": "prod"},
+			Plugins: plugins(utils.PluginDrifted, utils.PluginDrifted)},
+	}
+	tests := []struct {
+		name     string
+		req      utils.BulkDeployRequest
+		expected map[string][]string
+	}{
+		{"list", utils.BulkDeployRequest{Nodes: []string{"web2"}, Plugins: []string{"mysql"}},
+			map[string][]string{"web2": {"mysql"}}},
+		{"label", utils.BulkDeployRequest{Label: "env:prod"},
+			map[string][]string{"web1": {"apache", "mysql"}}},
+		{"label key", utils.BulkDeployRequest{Label: "env"},
+			map[string][]string{"web1": {"apache", "mysql"}, "web2": {"apache", "mysql"}}},
+		{"folder", utils.BulkDeployRequest{Folder: "/linux/web/"},
+			map[string][]string{"web1": {"apache", "mysql"}}},
+		{"drifted", utils.BulkDeployRequest{Drifted: true},
+			map[string][]string{"web1": {"mysql"}, "web2": {"apache", "mysql"}}},
+	}
+	for _, test := range tests {
+		plan, err := utils.PlanBulkDeploy(nodes, test.req)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(plan, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, plan)
+		}
+	}
+
+	if _, err := utils.PlanBulkDeploy(nodes, utils.BulkDeployRequest{Plugins: []string{"apache"}}); err == nil {
+		t.Errorf("Expected error without node selector")
+	}
+	if _, err := utils.PlanBulkDeploy(nodes, utils.BulkDeployRequest{Nodes: []string{"db1"}}); err == nil {
+		t.Errorf("Expected error for unavailable node")
+	}
+}
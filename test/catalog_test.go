@@ -0,0 +1,25 @@
+package test
+
+import (
+	"cmk_getter/utils"
+	"testing"
+)
+
+func TestParsePluginListing(t *testing.T) {
+	listing := `<html><body><h1>Index of /mysite/check_mk/agents/plugins</h1>
+<a href="?C=N;O=D">Name</a> <a href="?C=M;O=A">Last modified</a>
+<a href="/mysite/check_mk/agents/">Parent Directory</a>
+<a href="mk_apt">mk_apt</a> 2022-10-10 10:00 1.2K
+<a href="mk_logwatch.py">mk_logwatch.py</a> 2022-10-10 10:00 40K
+<a href="windows/">windows/</a>
+<a href="mk_apt">mk_apt</a>
+</body></html>`
+	names := utils.ParsePluginListing(listing)
+	if len(names) != 2 || names[0] != "mk_apt" || names[1] != "mk_logwatch.py" {
+		t.Errorf("Unexpected plugins: %v", names)
+	}
+	version := utils.ParsePluginVersion([]byte("#!/usr/bin/env python3\n__version__ = \"2.1.0p14\"\n"))
+	if version != "2.1.0p14" {
+		t.Errorf("Expected 2.1.0p14, got %s", version)
+	}
+}
@@ -0,0 +1,56 @@
+package test
+
+import (
+	"cmk_getter/config"
+	"gopkg.in/yaml.v2"
+	"reflect"
+	"testing"
+)
+
+func TestPluginConfigUnmarshalYAML(t *testing.T) {
+	cases := []struct {
+		name     string
+		yaml     string
+		expected []config.PluginConfig
+	}{
+		{
+			name:     "plain names",
+			yaml:     "plugins: [mk_apache, mk_mysql]",
+			expected: []config.PluginConfig{{Name: "mk_apache"}, {Name: "mk_mysql"}},
+		},
+		{
+			name:     "name and interval",
+			yaml:     "plugins:\n  - name: mk_apache\n    interval: 300\n",
+			expected: []config.PluginConfig{{Name: "mk_apache", Interval: 300}},
+		},
+		{
+			name: "mixed",
+			yaml: "plugins:\n  - mk_mysql\n  - name: mk_apache\n    interval: 600\n    sha256: abc\n  - mk_redis\n",
+			expected: []config.PluginConfig{
+				{Name: "mk_mysql"},
+				{Name: "mk_apache", Interval: 600, Sha256: "abc"},
+				{Name: "mk_redis"},
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var parsed struct {
+				Plugins []config.PluginConfig `yaml:"plugins"`
+			}
+			if err := yaml.Unmarshal([]byte(tc.yaml), &parsed); err != nil {
+				t.Fatalf("Error parsing yaml: %s", err)
+			}
+			if !reflect.DeepEqual(parsed.Plugins, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, parsed.Plugins)
+			}
+		})
+	}
+
+	var parsed struct {
+		Plugins []config.PluginConfig `yaml:"plugins"`
+	}
+	if err := yaml.Unmarshal([]byte("plugins:\n  - [mk_apache]\n"), &parsed); err == nil {
+		t.Errorf("Expected error for the list in the plugin list")
+	}
+}
@@ -0,0 +1,53 @@
+package test
+
+import (
+	"cmk_getter/utils"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildDigest(t *testing.T) {
+	now := time.Date(2023, 5, 10, 8, 0, 0, 0, time.UTC)
+	entries := []utils.HistoryEntry{
+		{Time: now.Add(-25 * time.Hour), Event: utils.NotifyNodeUnreachable, Host: "old"},
+		{Time: now.Add(-3 * time.Hour), Event: utils.NotifyAgentVersion, Version: "2.1.0p20"},
+		{Time: now.Add(-2 * time.Hour), Event: utils.NotifyNodeUnreachable, Host: "node2"},
+		{Time: now.Add(-time.Hour), Event: utils.HistoryDeploy, Host: "node1", Kind: utils.KindPlugin, Name: "mk_apache", Result: utils.PluginDeployed},
+		{Time: now.Add(-time.Hour), Event: utils.HistoryDeploy, Host: "node1", Kind: utils.KindPlugin, Name: "<mk_mysql>", Result: "failed", Error: "permission denied"},
+	}
+	nodes := []utils.CheckMkNode{
+		{Host: "node1", IsAvailable: true, Plugins: []utils.CheckMkPlugin{{Name: "<mk_mysql>", Status: utils.PluginDrifted}}},
+		{Host: "node2"},
+	}
+	digest := utils.BuildDigest(now, entries, nodes)
+	if len(digest.AgentVersions) != 1 || len(digest.Unreachable) != 1 || digest.Unreachable[0].Host != "node2" {
+		t.Errorf("Expected one version and one unreachable node of the last day, got %v %v", digest.AgentVersions, digest.Unreachable)
+	}
+	if len(digest.Deploys) != 2 || digest.DeploysOk != 1 || digest.DeploysFailed != 1 {
+		t.Errorf("Expected 1 succeeded and 1 failed deploy, got %d %d", digest.DeploysOk, digest.DeploysFailed)
+	}
+	if digest.Nodes != 2 || digest.AvailableNodes != 1 || len(digest.CurrentDrift) != 1 || digest.CurrentDrift[0].Host != "node1" {
+		t.Errorf("Expected drift on node1 and 1 of 2 nodes available, got %v", digest)
+	}
+
+	html, err := utils.RenderDigest(digest)
+	if err != nil {
+		t.Fatalf("Error rendering digest: %s", err)
+	}
+	for _, expected := range []string{"2023-05-10 06:00 node2", "permission denied", "&lt;mk_mysql&gt;", "1 succeeded, 1 failed"} {
+		if !strings.Contains(html, expected) {
+			t.Errorf("Expected %q in the digest:\n%s", expected, html)
+		}
+	}
+}
+
+func TestNextDigestTime(t *testing.T) {
+	now := time.Date(2023, 5, 10, 8, 30, 0, 0, time.UTC)
+	if next := utils.NextDigestTime(now, 9); !next.Equal(time.Date(2023, 5, 10, 9, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected digest today, got %s", next)
+	}
+	if next := utils.NextDigestTime(now, 8); !next.Equal(time.Date(2023, 5, 11, 8, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected digest tomorrow, got %s", next)
+	}
+}
@@ -0,0 +1,75 @@
+package test
+
+import (
+	"cmk_getter/utils"
+	"testing"
+)
+
+func TestPluginEvents(t *testing.T) {
+	events := utils.Events.Subscribe()
+	defer utils.Events.Unsubscribe(events)
+
+	utils.CheckMkNodeMap.Mutex.Lock()
+	utils.CheckMkNodeMap.Nodes["events1"] = utils.CheckMkNode{
+		Host:    "events1",
+		Plugins: []utils.CheckMkPlugin{{Name: "mk_apache", Status: utils.PluginDrifted}},
+	}
+	utils.CheckMkNodeMap.Mutex.Unlock()
+	defer func() {
+		utils.CheckMkNodeMap.Mutex.Lock()
+		delete(utils.CheckMkNodeMap.Nodes, "events1")
+		utils.CheckMkNodeMap.Mutex.Unlock()
+	}()
+
+	setStatus := func(status string) {
+		utils.CheckMkNodeMap.UpdateNodePlugin("events1", utils.CheckMkPlugin{Name: "mk_apache"}, func(plugin *utils.CheckMkPlugin) {
+			plugin.Status = status
+		})
+	}
+	setStatus(utils.PluginDeployed)
+	// Same status is not published
+	setStatus(utils.PluginDeployed)
+
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(events))
+	}
+	event := <-events
+	data, ok := event.Data.(utils.PluginEvent)
+	if event.Type != utils.EventPlugin || !ok {
+		t.Fatalf("Expected plugin event, got %s %v", event.Type, event.Data)
+	}
+	expected := utils.PluginEvent{Host: "events1", Kind: utils.KindPlugin, Name: "mk_apache",
+		Status: utils.PluginDeployed, PreviousStatus: utils.PluginDrifted}
+	if data != expected {
+		t.Errorf("Expected %v, got %v", expected, data)
+	}
+}
+
+func TestReliableSubscriber(t *testing.T) {
+	bus := utils.NewEventBus()
+	lossy := bus.Subscribe()
+	reliable := bus.SubscribeReliable()
+
+	// More events than the buffer of the lossy subscriber
+	count := 150
+	done := make(chan int)
+	go func() {
+		received := 0
+		for range reliable {
+			received++
+			if received == count {
+				break
+			}
+		}
+		done <- received
+	}()
+	for i := 0; i < count; i++ {
+		bus.Publish(utils.EventNode, utils.NodeEvent{Host: "node1"})
+	}
+	if received := <-done; received != count {
+		t.Errorf("Expected %d events for the reliable subscriber, got %d", count, received)
+	}
+	if len(lossy) != cap(lossy) {
+		t.Errorf("Expected the lossy subscriber full with %d events, got %d", cap(lossy), len(lossy))
+	}
+}
@@ -0,0 +1,101 @@
+package test
+
+import (
+	"cmk_getter/config"
+	"cmk_getter/utils"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDigestCache(t *testing.T) {
+	dataFolder := config.ConfigCmkGetter.DataFolder
+	config.ConfigCmkGetter.DataFolder = t.TempDir()
+	defer func() {
+		config.ConfigCmkGetter.DataFolder = dataFolder
+	}()
+	path := filepath.Join(t.TempDir(), "check-mk-agent_2.1.0p14-1_all.deb")
+	writeTestFile(t, path, "aaaa")
+	modTime := time.Date(2023, 5, 10, 8, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	cache := &utils.DigestCache{Digests: make(map[string]utils.FileDigest)}
+	_, sha256, err := cache.Get(path)
+	if err != nil || sha256 != utils.Sha256Hex([]byte("aaaa")) {
+		t.Fatalf("Expected sha256 of the file, got %s: %v", sha256, err)
+	}
+
+	// Same size and modification time, the cached hash is returned
+	writeTestFile(t, path, "bbbb")
+	_ = os.Chtimes(path, modTime, modTime)
+	if _, sha256, _ = cache.Get(path); sha256 != utils.Sha256Hex([]byte("aaaa")) {
+		t.Errorf("Expected the cached sha256, got %s", sha256)
+	}
+
+	// Changed modification time, the file is hashed again
+	_ = os.Chtimes(path, modTime.Add(time.Second), modTime.Add(time.Second))
+	if _, sha256, _ = cache.Get(path); sha256 != utils.Sha256Hex([]byte("bbbb")) {
+		t.Errorf("Expected the new sha256, got %s", sha256)
+	}
+
+	// Invalidated file is hashed again
+	writeTestFile(t, path, "cccc")
+	_ = os.Chtimes(path, modTime.Add(time.Second), modTime.Add(time.Second))
+	cache.Invalidate(path)
+	if _, sha256, _ = cache.Get(path); sha256 != utils.Sha256Hex([]byte("cccc")) {
+		t.Errorf("Expected sha256 after the invalidation, got %s", sha256)
+	}
+
+	if _, _, err = cache.Get(filepath.Join(filepath.Dir(path), "missing")); err == nil {
+		t.Errorf("Expected error for the missing file")
+	}
+}
+
+func TestLoadDigests(t *testing.T) {
+	dataFolder := config.ConfigCmkGetter.DataFolder
+	config.ConfigCmkGetter.DataFolder = t.TempDir()
+	digests := utils.FileDigests.Digests
+	defer func() {
+		config.ConfigCmkGetter.DataFolder = dataFolder
+		utils.FileDigests.Digests = digests
+	}()
+	path := filepath.Join(t.TempDir(), "mk_apache")
+	writeTestFile(t, path, "plugin")
+
+	statePath := filepath.Join(config.ConfigCmkGetter.DataFolder, "digests.json")
+
+	cache := &utils.DigestCache{Digests: make(map[string]utils.FileDigest)}
+	if _, _, err := cache.Get(path); err != nil {
+		t.Fatal(err)
+	}
+	// Hashed files are not written one by one
+	if _, err := os.Stat(statePath); !os.IsNotExist(err) {
+		t.Fatalf("Expected no state file before the save, got %v", err)
+	}
+	if err := cache.Save(); err != nil {
+		t.Fatalf("Error saving digests: %s", err)
+	}
+	// Unchanged cache is not written again
+	_ = os.Remove(statePath)
+	if err := cache.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(statePath); !os.IsNotExist(err) {
+		t.Fatalf("Expected no write of the unchanged cache, got %v", err)
+	}
+	cache.Invalidate(filepath.Join(filepath.Dir(path), "missing"))
+	cache.Invalidate(path)
+	_, _, _ = cache.Get(path)
+	if err := cache.Save(); err != nil {
+		t.Fatal(err)
+	}
+	utils.FileDigests.Digests = nil
+	utils.LoadDigests()
+	digest, ok := utils.FileDigests.Digests[path]
+	if !ok || digest.Sha256 != utils.Sha256Hex([]byte("plugin")) || digest.Size != 6 {
+		t.Errorf("Expected the saved digest of %s, got %v", path, utils.FileDigests.Digests)
+	}
+}
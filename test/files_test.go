@@ -0,0 +1,75 @@
+package test
+
+import (
+	"cmk_getter/config"
+	"cmk_getter/utils"
+	"path/filepath"
+	"testing"
+)
+
+// Hashes of the "abc" content
+const (
+	abcMd5    = "900150983cd24fb0d6963f7d28e17f72"
+	abcSha256 = "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+)
+
+// newFilesFolder Return the folder with the agent file, the file digests are cached in the temp data folder
+func newFilesFolder(t *testing.T) string {
+	saved := config.ConfigCmkGetter.DataFolder
+	config.ConfigCmkGetter.DataFolder = t.TempDir()
+	t.Cleanup(func() {
+		config.ConfigCmkGetter.DataFolder = saved
+	})
+	folder := t.TempDir()
+	writeTestFile(t, filepath.Join(folder, "check-mk-agent_2.1.0p14-1_all.deb"), "abc")
+	return folder
+}
+
+func TestGetFileHashes(t *testing.T) {
+	folder := newFilesFolder(t)
+	md5, sha256, err := utils.GetFileHashes(filepath.Join(folder, "check-mk-agent_2.1.0p14-1_all.deb"))
+	if err != nil || md5 != abcMd5 || sha256 != abcSha256 {
+		t.Errorf("Expected the hashes of the file, got %s %s: %v", md5, sha256, err)
+	}
+	if _, _, err = utils.GetFileHashes(filepath.Join(folder, "missing")); err == nil {
+		t.Errorf("Expected error for the missing file")
+	}
+}
+
+func TestGetFolderFiles(t *testing.T) {
+	folder := newFilesFolder(t)
+	files, err := utils.GetFolderFiles(folder)
+	if err != nil {
+		t.Fatalf("Error listing folder: %s", err)
+	}
+	if len(files) != 1 || files[0].Name != "check-mk-agent_2.1.0p14-1_all.deb" || files[0].Size != 3 {
+		t.Fatalf("Expected the agent file, got %v", files)
+	}
+	if files[0].MD5 != abcMd5 || files[0].SHA256 != abcSha256 {
+		t.Errorf("Expected the hashes in the listing, got %s %s", files[0].MD5, files[0].SHA256)
+	}
+	if _, err = utils.GetFolderFiles(filepath.Join(folder, "missing")); err == nil {
+		t.Errorf("Expected error for the missing folder")
+	}
+}
+
+func TestChecksumHeaders(t *testing.T) {
+	folder := newFilesFolder(t)
+	headers, err := utils.ChecksumHeaders(filepath.Join(folder, "check-mk-agent_2.1.0p14-1_all.deb"))
+	if err != nil {
+		t.Fatalf("Error reading checksums: %s", err)
+	}
+	expected := map[string]string{
+		"X-Checksum-Md5":    abcMd5,
+		"X-Checksum-Sha256": abcSha256,
+		"Digest":            "SHA-256=ungWv48Bz+pBQUDeXa4iI7ADYaOWF3qctBD/YfIAFa0=,MD5=kAFQmDzST7DWlj99KOF/cg==",
+	}
+	for name, value := range expected {
+		if headers[name] != value {
+			t.Errorf("Expected %s header %s, got %s", name, value, headers[name])
+		}
+	}
+	if _, err = utils.ChecksumHeaders(filepath.Join(folder, "missing")); err == nil {
+		t.Errorf("Expected error for the missing file")
+	}
+}
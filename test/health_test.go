@@ -0,0 +1,56 @@
+package test
+
+import (
+	"cmk_getter/utils"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHealthSubsystems(t *testing.T) {
+	started := time.Now()
+	health := utils.NewHealthRegistry(started)
+	health.Register("checker", time.Minute)
+	health.Register("refresher", time.Minute)
+
+	health.Start("refresher")
+	health.Finish("refresher", errors.New("connection refused"))
+
+	states := health.Subsystems(started.Add(2 * time.Minute))
+	if len(states) != 2 || states[0].Name != "checker" || states[0].Stalled {
+		t.Fatalf("Expected not stalled checker first, got %v", states)
+	}
+	if !states[1].Failing || states[1].LastError != "connection refused" || states[1].Runs != 1 {
+		t.Errorf("Expected failing refresher with error, got %v", states[1])
+	}
+
+	// Checker never finished a run, refresher finished it just now
+	states = health.Subsystems(started.Add(4 * time.Minute))
+	if !states[0].Stalled {
+		t.Errorf("Expected stalled checker after 3 intervals")
+	}
+	if !states[1].Stalled {
+		t.Errorf("Expected stalled refresher after 3 intervals since the last run")
+	}
+	health.Finish("checker", nil)
+	states = health.Subsystems(time.Now())
+	if states[0].Stalled || states[0].Failing {
+		t.Errorf("Expected healthy checker after the run, got %v", states[0])
+	}
+}
+
+func TestCheckFolderWritable(t *testing.T) {
+	folder := t.TempDir()
+	if state := utils.CheckFolderWritable(folder); !state.Writable {
+		t.Errorf("Expected writable folder, got error %s", state.Error)
+	}
+	entries, _ := os.ReadDir(folder)
+	if len(entries) != 0 {
+		t.Errorf("Expected the test file to be removed, got %d files", len(entries))
+	}
+	if state := utils.CheckFolderWritable(filepath.Join(folder, "missing")); state.Writable || state.Error == "" {
+		t.Errorf("Expected error for missing folder")
+	}
+}
@@ -0,0 +1,46 @@
+package test
+
+import (
+	"cmk_getter/config"
+	"cmk_getter/utils"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistorySave(t *testing.T) {
+	dataFolder := config.ConfigCmkGetter.DataFolder
+	config.ConfigCmkGetter.DataFolder = t.TempDir()
+	defer func() {
+		config.ConfigCmkGetter.DataFolder = dataFolder
+	}()
+	statePath := filepath.Join(config.ConfigCmkGetter.DataFolder, "history.json")
+
+	history := &utils.HistoryLog{}
+	history.Add(utils.HistoryEntry{Time: time.Now().Add(-8 * 24 * time.Hour), Event: utils.HistoryDeploy, Name: "expired"})
+	history.Add(utils.HistoryEntry{Event: utils.HistoryDeploy, Host: "node1", Name: "mk_apache"})
+	if _, err := os.Stat(statePath); !os.IsNotExist(err) {
+		t.Fatalf("Expected no state file before the save, got %v", err)
+	}
+	if err := history.Save(); err != nil {
+		t.Fatalf("Error saving history: %s", err)
+	}
+
+	loaded := &utils.HistoryLog{}
+	if err := loaded.Load(); err != nil {
+		t.Fatalf("Error loading history: %s", err)
+	}
+	if len(loaded.Entries) != 1 || loaded.Entries[0].Name != "mk_apache" {
+		t.Errorf("Expected the deploy without the expired entry, got %v", loaded.Entries)
+	}
+
+	// Unchanged history is not written again
+	_ = os.Remove(statePath)
+	if err := history.Save(); err != nil {
+		t.Fatalf("Error saving history: %s", err)
+	}
+	if _, err := os.Stat(statePath); !os.IsNotExist(err) {
+		t.Errorf("Expected no write of the unchanged history, got %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package test
+
+import (
+	"cmk_getter/utils"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// waitJob Wait for the job to finish
+func waitJob(t *testing.T, id string) utils.Job {
+	for i := 0; i < 100; i++ {
+		job, ok := utils.Jobs.Get(id)
+		if !ok {
+			t.Fatalf("Job %s not found", id)
+		}
+		if job.FinishedAt != nil {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Job %s is not finished", id)
+	return utils.Job{}
+}
+
+func TestJobQueue(t *testing.T) {
+	utils.JobWorkers()
+
+	ok, _ := utils.Jobs.Submit("test", func(ctx context.Context, step utils.StepLogger) (interface{}, error) {
+		step("step %d", 1)
+		return "done", nil
+	})
+	job := waitJob(t, ok.Id)
+	if job.Status != utils.JobSucceeded || job.Result != "done" {
+		t.Errorf("Expected succeeded job with result, got %s %v", job.Status, job.Result)
+	}
+	if len(job.Steps) != 1 || job.Steps[0].Message != "step 1" {
+		t.Errorf("Expected one step, got %v", job.Steps)
+	}
+
+	failed, _ := utils.Jobs.Submit("test", func(ctx context.Context, step utils.StepLogger) (interface{}, error) {
+		return nil, errors.New("boom")
+	})
+	job = waitJob(t, failed.Id)
+	if job.Status != utils.JobFailed || job.Error != "boom" {
+		t.Errorf("Expected failed job with error, got %s %s", job.Status, job.Error)
+	}
+
+	started := make(chan bool)
+	cancelled, _ := utils.Jobs.Submit("test", func(ctx context.Context, step utils.StepLogger) (interface{}, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	<-started
+	if err := utils.Jobs.Cancel(cancelled.Id); err != nil {
+		t.Fatalf("Error cancelling job: %s", err)
+	}
+	job = waitJob(t, cancelled.Id)
+	if job.Status != utils.JobCancelled {
+		t.Errorf("Expected cancelled job, got %s", job.Status)
+	}
+	if err := utils.Jobs.Cancel(cancelled.Id); err == nil {
+		t.Errorf("Expected error cancelling finished job")
+	}
+}
+
+// TestJobCancelledAfterFinish The job finished after the cancel request keeps its result
+func TestJobCancelledAfterFinish(t *testing.T) {
+	utils.JobWorkers()
+	cases := map[string]struct {
+		err    error
+		status string
+	}{
+		"succeeded": {nil, utils.JobSucceeded},
+		"failed":    {errors.New("boom"), utils.JobFailed},
+		"cancelled": {fmt.Errorf("deploy: %w", context.Canceled), utils.JobCancelled},
+	}
+	for name, tc := range cases {
+		started := make(chan bool)
+		cancelRequested := make(chan bool)
+		job, _ := utils.Jobs.Submit("test", func(ctx context.Context, step utils.StepLogger) (interface{}, error) {
+			close(started)
+			<-cancelRequested
+			<-ctx.Done()
+			return "result", tc.err
+		})
+		<-started
+		if err := utils.Jobs.Cancel(job.Id); err != nil {
+			t.Fatalf("Error cancelling job: %s", err)
+		}
+		close(cancelRequested)
+		finished := waitJob(t, job.Id)
+		if finished.Status != tc.status || finished.Result != "result" {
+			t.Errorf("%s: expected %s job with the result, got %s %v", name, tc.status, finished.Status, finished.Result)
+		}
+	}
+}
+
+func TestJobQueueFull(t *testing.T) {
+	// Queue without workers
+	queue := utils.NewJobQueue(1)
+	noop := func(ctx context.Context, step utils.StepLogger) (interface{}, error) {
+		return nil, nil
+	}
+	queued, err := queue.SubmitAs("admin", "test", noop)
+	if err != nil || queued.Actor != "admin" || queued.Status != utils.JobQueued {
+		t.Fatalf("Expected queued job of admin, got %v %v", queued, err)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := queue.Submit("test", noop)
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		if !errors.Is(err, utils.ErrJobQueueFull) {
+			t.Errorf("Expected full queue error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Submit is blocked by the full queue")
+	}
+	if jobs := queue.List(); len(jobs) != 1 {
+		t.Errorf("Expected only the queued job, got %v", jobs)
+	}
+}
@@ -0,0 +1,43 @@
+package test
+
+import (
+	"net"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestLocalCheckWithoutConfig Run the local-check subcommand in a folder without config.yaml
+// and without the running cmk_getter, the CRIT service must be printed for Check_MK
+func TestLocalCheckWithoutConfig(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the binary")
+	}
+	dir := t.TempDir()
+	binary := filepath.Join(dir, "cmk_getter")
+	build := exec.Command("go", "build", "-o", binary, "cmk_getter/cmd")
+	if output, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("Error building cmk_getter: %s\n%s", err, output)
+	}
+
+	// Closed port of the not running cmk_getter
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + listener.Addr().String() + "/api/local-check"
+	_ = listener.Close()
+
+	for _, args := range [][]string{{"local-check"}, {"local-check", url}} {
+		command := exec.Command(binary, args...)
+		command.Dir = dir
+		output, err := command.Output()
+		if err != nil {
+			t.Fatalf("Expected exit code 0 for %v, got %s: %s", args, err, output)
+		}
+		if !strings.HasPrefix(string(output), "<<<local:sep(0)>>>\n2 \"cmk_getter\"") {
+			t.Errorf("Expected CRIT local check for %v, got:\n%s", args, output)
+		}
+	}
+}
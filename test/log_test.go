@@ -0,0 +1,104 @@
+package test
+
+import (
+	"bytes"
+	"cmk_getter/log"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLogFormats(t *testing.T) {
+	var output bytes.Buffer
+	log.Logger.SetOutput(&output)
+	defer func() {
+		log.SetLogFormat(log.FormatText)
+		log.Logger.SetOutput(os.Stderr)
+	}()
+
+	log.SetLogFormat(log.FormatText)
+	log.WithPlugin("node1", "mk apache").Infof("Plugin %s deployed", "mk apache")
+	if !strings.HasSuffix(output.String(), " INFO Plugin mk apache deployed node=node1 plugin=\"mk apache\"\n") {
+		t.Errorf("Unexpected text log: %q", output.String())
+	}
+
+	output.Reset()
+	log.SetLogFormat(log.FormatJson)
+	log.WithJob("42").Infoln("Job queued")
+	var entry map[string]string
+	if err := json.Unmarshal(output.Bytes(), &entry); err != nil || entry["job_id"] != "42" || entry["msg"] != "Job queued" {
+		t.Errorf("Unexpected json log: %q", output.String())
+	}
+
+	output.Reset()
+	log.SetLogFormat(log.FormatLogfmt)
+	log.WithVersion("2.1.0p20").Infoln("New version")
+	if !strings.Contains(output.String(), `level=info msg="New version" version=2.1.0p20`) {
+		t.Errorf("Unexpected logfmt log: %q", output.String())
+	}
+}
+
+func TestGinrusLogger(t *testing.T) {
+	var output bytes.Buffer
+	log.Logger.SetOutput(&output)
+	defer log.Logger.SetOutput(os.Stderr)
+
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	r.Use(log.GinrusLogger(), gin.BasicAuth(gin.Accounts{"admin": "secret"}))
+	r.GET("/missing", func(c *gin.Context) {
+		c.String(404, "not found")
+	})
+	req := httptest.NewRequest(http.MethodGet, "/missing", nil)
+	req.SetBasicAuth("admin", "secret")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	line := output.String()
+	for _, expected := range []string{" WARN HTTP Request ", "status=404", "bytes=9", "user=admin", "path=/missing", "method=GET", "latency="} {
+		if !strings.Contains(line, expected) {
+			t.Errorf("Expected %q in the access log: %q", expected, line)
+		}
+	}
+}
+
+func TestRequestActor(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+	actors := make(chan string, 1)
+	handler := func(c *gin.Context) {
+		actors <- log.RequestActor(c)
+	}
+	r := gin.New()
+	r.GET("/open", handler)
+	r.GET("/auth", gin.BasicAuth(gin.Accounts{"admin": "secret"}), handler)
+
+	cases := []struct {
+		path, user, password, expected string
+	}{
+		{"/open", "", "", "anonymous@192.0.2.1"},
+		{"/open", "admin", "wrong", "unverified:admin@192.0.2.1"},
+		{"/auth", "admin", "secret", "admin"},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		if tc.user != "" {
+			req.SetBasicAuth(tc.user, tc.password)
+		}
+		r.ServeHTTP(httptest.NewRecorder(), req)
+		if actor := <-actors; actor != tc.expected {
+			t.Errorf("Expected %s for %s, got %s", tc.expected, tc.path, actor)
+		}
+	}
+
+	// Wrong password is refused by the middleware
+	req := httptest.NewRequest(http.MethodGet, "/auth", nil)
+	req.SetBasicAuth("admin", "wrong")
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusUnauthorized || len(actors) != 0 {
+		t.Errorf("Expected 401 without the handler, got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,42 @@
+package test
+
+import (
+	"cmk_getter/utils"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	utils.Metrics.ObserveSSHDial("node1", 2*time.Second, nil)
+	utils.Metrics.ObserveSSHDial("node1", time.Second, errors.New("timeout"))
+	utils.Metrics.ObserveHTTPRequest("https://example.com/plugin", 300*time.Millisecond, 200, nil)
+	utils.Metrics.ObserveDeploy("", utils.PluginFailing)
+
+	nodes := []utils.CheckMkNode{
+		{Host: "node1", IsAvailable: true, Plugins: []utils.CheckMkPlugin{{Name: `mk_"apache"`, Status: utils.PluginDeployed}}},
+		{Host: "node2", Plugins: []utils.CheckMkPlugin{{Name: `mk_"apache"`, Status: utils.PluginDeployed}}},
+	}
+	var output strings.Builder
+	if err := utils.Metrics.WriteMetrics(&output, nodes); err != nil {
+		t.Fatalf("Error writing metrics: %s", err)
+	}
+	expected := []string{
+		"# TYPE cmk_getter_nodes gauge\ncmk_getter_nodes 2\n",
+		"\ncmk_getter_nodes_available 1\n",
+		`cmk_getter_plugin_nodes{kind="plugin",plugin="mk_\"apache\"",status="deployed"} 2`,
+		`cmk_getter_ssh_dial_duration_seconds_sum{host="node1"} 3`,
+		`cmk_getter_ssh_dial_duration_seconds_count{host="node1"} 2`,
+		`cmk_getter_ssh_dial_failures_total{host="node1"} 1`,
+		`cmk_getter_http_request_duration_seconds_bucket{target="external",le="0.25"} 0`,
+		`cmk_getter_http_request_duration_seconds_bucket{target="external",le="0.5"} 1`,
+		`cmk_getter_http_requests_total{target="external",code="200"} 1`,
+		`cmk_getter_deploys_total{kind="plugin",result="failing"} 1`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(output.String(), line) {
+			t.Errorf("Expected %q in the metrics:\n%s", line, output.String())
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package test
+
+import (
+	"cmk_getter/config"
+	"cmk_getter/utils"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNotificationFromEvent(t *testing.T) {
+	tests := []struct {
+		data     interface{}
+		expected string
+	}{
+		{utils.AgentVersionEvent{Version: "2.1.0p20"}, utils.NotifyAgentVersion},
+		{utils.NodeEvent{Host: "node1"}, utils.NotifyNodeUnreachable},
+		{utils.NodeEvent{Host: "node1", FirstCheck: true}, ""},
+		{utils.PluginEvent{Status: utils.PluginDrifted, PreviousStatus: utils.PluginDeployed}, utils.NotifyPluginDrifted},
+		{utils.PluginEvent{Status: utils.PluginDeployed, PreviousStatus: utils.PluginDrifted}, ""},
+		{utils.JobEvent{Type: utils.JobBulkDeploy, Status: utils.JobFailed}, utils.NotifyDeployFailed},
+		{utils.JobEvent{Type: utils.JobBulkDeploy, Status: utils.JobRunning}, ""},
+	}
+	for _, test := range tests {
+		n, ok := utils.NotificationFromEvent(utils.Event{Data: test.data})
+		if ok != (test.expected != "") || n.Event != test.expected {
+			t.Errorf("Expected notification %q for %v, got %q %v", test.expected, test.data, n.Event, ok)
+		}
+	}
+}
+
+func TestNotifierDeliver(t *testing.T) {
+	var mutex sync.Mutex
+	var bodies []map[string]string
+	failures := 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		var body map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		bodies = append(bodies, body)
+	}))
+	defer server.Close()
+
+	notifier := utils.NewNotifier([]config.WebhookConfig{
+		{Name: "slack", Url: server.URL, Format: utils.WebhookSlack, Events: []string{utils.NotifyNodeUnreachable}},
+		{Name: "other", Url: server.URL, Events: []string{utils.NotifyAgentVersion}},
+		{Name: "down", Url: server.URL + "/missing", Retries: -1, Format: "xml"},
+	})
+	notifier.RetryDelay = time.Millisecond
+	deliveries := notifier.Notify(utils.Notification{Event: utils.NotifyNodeUnreachable, Title: "Node node1 is unreachable", Text: "SSH"})
+	if len(deliveries) != 2 {
+		t.Fatalf("Expected 2 deliveries, got %v", deliveries)
+	}
+	for _, delivery := range notifier.Deliveries() {
+		switch delivery.Webhook {
+		case "slack":
+			if !delivery.Success || delivery.Attempts != 2 || delivery.StatusCode != 200 {
+				t.Errorf("Expected success after retry, got %v", delivery)
+			}
+		case "down":
+			if delivery.Success || delivery.Error == "" || delivery.Attempts != 0 {
+				t.Errorf("Expected error for unknown format, got %v", delivery)
+			}
+		default:
+			t.Errorf("Unexpected delivery %v", delivery)
+		}
+	}
+	if len(bodies) != 1 || bodies[0]["text"] != "*Node node1 is unreachable*\nSSH" {
+		t.Errorf("Expected slack payload, got %v", bodies)
+	}
+}
@@ -0,0 +1,112 @@
+package test
+
+import (
+	"cmk_getter/utils"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// pluginServer Check_MK server with one plugin, the validators of the requests are saved
+type pluginServer struct {
+	mutex        sync.Mutex
+	content      string
+	etag         string
+	requests     int
+	ifNoneMatch  string
+	ifModified   string
+	lastModified string
+}
+
+func (s *pluginServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.requests++
+	s.ifNoneMatch = r.Header.Get("If-None-Match")
+	s.ifModified = r.Header.Get("If-Modified-Since")
+	if s.ifNoneMatch == s.etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", s.etag)
+	w.Header().Set("Last-Modified", s.lastModified)
+	_, _ = w.Write([]byte(s.content))
+}
+
+// set Change the plugin on the server
+func (s *pluginServer) set(content, etag string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.content = content
+	s.etag = etag
+}
+
+// stats Return the number of requests and the validators of the last request
+func (s *pluginServer) stats() (int, string, string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.requests, s.ifNoneMatch, s.ifModified
+}
+
+func TestPluginCacheGet(t *testing.T) {
+	plugin := &pluginServer{content: "v1", etag: `"v1"`, lastModified: "Wed, 10 May 2023 08:00:00 GMT"}
+	server := httptest.NewServer(plugin)
+	defer server.Close()
+	url := server.URL + "/mk_apache"
+	cache := &utils.PluginCache{Plugins: make(map[string]*utils.CachedPlugin), Cycle: 1}
+
+	// Many nodes of the same cycle download the plugin once
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cached, err := cache.Get(url)
+			if err != nil || string(cached.Content) != "v1" {
+				t.Errorf("Expected v1, got %q: %v", cached.Content, err)
+			}
+		}()
+	}
+	wg.Wait()
+	requests, ifNoneMatch, ifModified := plugin.stats()
+	if requests != 1 || ifNoneMatch != "" || ifModified != "" {
+		t.Fatalf("Expected 1 request without validators, got %d %q %q", requests, ifNoneMatch, ifModified)
+	}
+
+	// Not modified plugin is revalidated in the next cycle and the cached bytes are returned
+	cache.NewCycle()
+	cached, err := cache.Get(url)
+	if err != nil || string(cached.Content) != "v1" || cached.Sha256 != utils.Sha256Hex([]byte("v1")) {
+		t.Errorf("Expected cached v1, got %q %s: %v", cached.Content, cached.Sha256, err)
+	}
+	_, _ = cache.Get(url)
+	requests, ifNoneMatch, ifModified = plugin.stats()
+	if requests != 2 || ifNoneMatch != `"v1"` || ifModified != "Wed, 10 May 2023 08:00:00 GMT" {
+		t.Errorf("Expected 2 requests with validators, got %d %q %q", requests, ifNoneMatch, ifModified)
+	}
+
+	// Changed plugin is downloaded in the next cycle
+	plugin.set("v2", `"v2"`)
+	cached, _ = cache.Get(url)
+	if string(cached.Content) != "v1" {
+		t.Errorf("Expected v1 until the next cycle, got %q", cached.Content)
+	}
+	cache.NewCycle()
+	cached, err = cache.Get(url)
+	if err != nil || string(cached.Content) != "v2" || cached.ETag != `"v2"` || cached.Size != 2 {
+		t.Errorf("Expected v2, got %q %s %d: %v", cached.Content, cached.ETag, cached.Size, err)
+	}
+	if requests, _, _ = plugin.stats(); requests != 3 {
+		t.Errorf("Expected 3 requests, got %d", requests)
+	}
+}
+
+func TestPluginCacheGetError(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	cache := &utils.PluginCache{Plugins: make(map[string]*utils.CachedPlugin), Cycle: 1}
+	if _, err := cache.Get(server.URL + "/mk_missing"); err == nil {
+		t.Errorf("Expected error for the missing plugin")
+	}
+}
@@ -0,0 +1,92 @@
+package test
+
+import (
+	"cmk_getter/config"
+	"cmk_getter/utils"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGetPluginSource(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/site/check_mk/agents/plugins/mk_test":
+			_, _ = w.Write([]byte("upstream"))
+		case "/custom/mk_test":
+			_, _ = w.Write([]byte("url"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	// Trust the certificate of the test server
+	transport := http.DefaultTransport
+	http.DefaultTransport = server.Client().Transport
+	saved := config.ConfigCmkGetter
+	defer func() {
+		http.DefaultTransport = transport
+		config.ConfigCmkGetter = saved
+	}()
+	dir := t.TempDir()
+	config.ConfigCmkGetter.Domain = strings.TrimPrefix(server.URL, "https://")
+	config.ConfigCmkGetter.Site = "site"
+
+	cases := []struct {
+		name   string
+		plugin utils.CheckMkPlugin
+		// Local plugin files, relative to the temporary folder
+		local    map[string]string
+		expected string
+		fails    bool
+	}{
+		{name: "auto local folder", plugin: utils.CheckMkPlugin{Name: "mk_test"},
+			local: map[string]string{"plugins/mk_test": "local"}, expected: "local"},
+		{name: "auto git checkout", plugin: utils.CheckMkPlugin{Name: "mk_test"},
+			local: map[string]string{"git/mk_test": "git"}, expected: "git"},
+		{name: "auto local folder before git checkout", plugin: utils.CheckMkPlugin{Name: "mk_test"},
+			local: map[string]string{"plugins/mk_test": "local", "git/mk_test": "git"}, expected: "local"},
+		{name: "auto upstream without override", plugin: utils.CheckMkPlugin{Name: "mk_test"}, expected: "upstream"},
+		{name: "upstream ignores override", plugin: utils.CheckMkPlugin{Name: "mk_test", Source: utils.SourceUpstream},
+			local: map[string]string{"plugins/mk_test": "local"}, expected: "upstream"},
+		{name: "local", plugin: utils.CheckMkPlugin{Name: "mk_test", Source: utils.SourceLocal},
+			local: map[string]string{"git/mk_test": "git"}, expected: "git"},
+		{name: "local without override", plugin: utils.CheckMkPlugin{Name: "mk_test", Source: utils.SourceLocal}, fails: true},
+		{name: "url", plugin: utils.CheckMkPlugin{Name: "mk_test", Source: utils.SourceUrl, Url: server.URL + "/custom/mk_test"},
+			local: map[string]string{"plugins/mk_test": "local"}, expected: "url"},
+		{name: "url without url", plugin: utils.CheckMkPlugin{Name: "mk_test", Source: utils.SourceUrl}, fails: true},
+		{name: "url not found", plugin: utils.CheckMkPlugin{Name: "mk_test", Source: utils.SourceUrl, Url: server.URL + "/missing"}, fails: true},
+		{name: "unknown source", plugin: utils.CheckMkPlugin{Name: "mk_test", Source: "ftp"}, fails: true},
+		{name: "pinned sha256", plugin: utils.CheckMkPlugin{Name: "mk_test",
+			PinnedSha256: strings.ToUpper(utils.Sha256Hex([]byte("upstream")))}, expected: "upstream"},
+		{name: "pinned sha256 mismatch", plugin: utils.CheckMkPlugin{Name: "mk_test", PinnedSha256: utils.Sha256Hex([]byte("other"))},
+			fails: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Own folders for each case
+			caseDir := filepath.Join(dir, tc.name)
+			config.ConfigCmkGetter.PluginsFolder = filepath.Join(caseDir, "plugins")
+			config.ConfigCmkGetter.PluginsGitPath = filepath.Join(caseDir, "git")
+			for path, content := range tc.local {
+				writeTestFile(t, filepath.Join(caseDir, path), content)
+			}
+			c := tc.plugin
+			err := utils.GetPlugin(&c)
+			if tc.fails {
+				if err == nil {
+					t.Errorf("Expected error, got %q", c.ByteContent)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Error getting plugin: %s", err)
+			}
+			if string(c.ByteContent) != tc.expected || c.Sha256 != utils.Sha256Hex([]byte(tc.expected)) {
+				t.Errorf("Expected %q, got %q %s", tc.expected, c.ByteContent, c.Sha256)
+			}
+		})
+	}
+}
@@ -0,0 +1,256 @@
+package test
+
+import (
+	"cmk_getter/config"
+	"cmk_getter/utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlanWaves(t *testing.T) {
+	nodes := []string{"n1", "n2", "n3", "n4", "n5", "n6", "n7", "n8", "n9", "n10", "canary1"}
+	waves := utils.PlanWaves(nodes, []string{"canary1"}, []int{10, 50})
+	expected := []int{1, 1, 4, 5}
+	if len(waves) != len(expected) {
+		t.Fatalf("Expected %d waves, got %d", len(expected), len(waves))
+	}
+	if waves[0].Name != "canary" || waves[0].Hosts[0] != "canary1" {
+		t.Errorf("Expected canary wave first, got %v", waves[0])
+	}
+	total := 0
+	for i, wave := range waves {
+		if len(wave.Hosts) != expected[i] {
+			t.Errorf("Expected %d hosts in wave %s, got %d", expected[i], wave.Name, len(wave.Hosts))
+		}
+		total += len(wave.Hosts)
+	}
+	if total != len(nodes) {
+		t.Errorf("Expected %d hosts in all waves, got %d", len(nodes), total)
+	}
+}
+
+// TestPinnedAgentPackage The pinned package stays the same when the latest symlink is moved to a new version
+func TestPinnedAgentPackage(t *testing.T) {
+	dir := t.TempDir()
+	saved := config.ConfigCmkGetter.AgentPackageFolder
+	config.ConfigCmkGetter.AgentPackageFolder = dir
+	defer func() {
+		config.ConfigCmkGetter.AgentPackageFolder = saved
+	}()
+	latest := filepath.Join(dir, "check-mk-agent-latest.deb")
+	writeTestFile(t, filepath.Join(dir, "check-mk-agent_2.1.0p14-1_all.deb"), "old agent")
+	writeTestFile(t, filepath.Join(dir, "check-mk-agent_2.1.0p20-1_all.deb"), "new agent")
+	if err := os.Symlink("check-mk-agent_2.1.0p14-1_all.deb", latest); err != nil {
+		t.Fatal(err)
+	}
+
+	pkg, err := utils.LatestAgentPackage(utils.PackageDeb)
+	if err != nil {
+		t.Fatalf("Error reading latest package: %s", err)
+	}
+	if pkg.Version != "2.1.0p14" || pkg.Sha256 != utils.Sha256Hex([]byte("old agent")) {
+		t.Errorf("Expected pinned 2.1.0p14, got %v", pkg)
+	}
+
+	// New version is downloaded during the rollout
+	_ = os.Remove(latest)
+	if err := os.Symlink("check-mk-agent_2.1.0p20-1_all.deb", latest); err != nil {
+		t.Fatal(err)
+	}
+	content, err := utils.ReadAgentPackage(pkg)
+	if err != nil || string(content) != "old agent" {
+		t.Errorf("Expected the pinned package, got %q: %v", content, err)
+	}
+
+	// Pinned package file is changed
+	writeTestFile(t, pkg.Path, "tampered agent")
+	if _, err := utils.ReadAgentPackage(pkg); err == nil {
+		t.Errorf("Expected sha256 mismatch error")
+	}
+	if _, err := utils.ReadAgentPackage(utils.AgentPackage{}); err == nil {
+		t.Errorf("Expected error without package")
+	}
+}
+
+// rolloutHosts Unavailable nodes of the rollout tests, the upgrade of each node fails
+var rolloutHosts = []string{"rollout1", "rollout2", "rollout3", "rollout4"}
+
+// newRolloutTest Set the agent package folder with the deb package, the data folder and the nodes
+// Return the sha256 of the package
+func newRolloutTest(t *testing.T) string {
+	dir := t.TempDir()
+	saved := config.ConfigCmkGetter
+	config.ConfigCmkGetter.AgentPackageFolder = filepath.Join(dir, "agents")
+	config.ConfigCmkGetter.DataFolder = filepath.Join(dir, "data")
+	writeTestFile(t, filepath.Join(dir, "agents", "check-mk-agent_2.1.0p14-1_all.deb"), "agent")
+	if err := os.Symlink("check-mk-agent_2.1.0p14-1_all.deb", filepath.Join(dir, "agents", "check-mk-agent-latest.deb")); err != nil {
+		t.Fatal(err)
+	}
+
+	utils.CheckMkNodeMap.Mutex.Lock()
+	for _, host := range rolloutHosts {
+		utils.CheckMkNodeMap.Nodes[host] = utils.CheckMkNode{Host: host}
+	}
+	utils.CheckMkNodeMap.Mutex.Unlock()
+	utils.Rollouts.Mutex.Lock()
+	rollouts := utils.Rollouts.Rollouts
+	utils.Rollouts.Rollouts = make(map[string]*utils.Rollout)
+	utils.Rollouts.Mutex.Unlock()
+	t.Cleanup(func() {
+		utils.CheckMkNodeMap.Mutex.Lock()
+		for _, host := range rolloutHosts {
+			delete(utils.CheckMkNodeMap.Nodes, host)
+		}
+		utils.CheckMkNodeMap.Mutex.Unlock()
+		utils.Rollouts.Mutex.Lock()
+		utils.Rollouts.Rollouts = rollouts
+		utils.Rollouts.Mutex.Unlock()
+		config.ConfigCmkGetter = saved
+	})
+	return utils.Sha256Hex([]byte("agent"))
+}
+
+// waitRollout Wait until the rollout is not running
+func waitRollout(t *testing.T, id string) utils.Rollout {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		rollout, ok := utils.Rollouts.Get(id)
+		if !ok {
+			t.Fatalf("Rollout %s not found", id)
+		}
+		if rollout.Status != utils.RolloutRunning {
+			return rollout
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Rollout %s is still running", id)
+	return utils.Rollout{}
+}
+
+func TestRolloutFailureThreshold(t *testing.T) {
+	cases := []struct {
+		name      string
+		threshold float64
+		status    string
+		wave      int
+		results   int
+	}{
+		// All nodes fail, the rollout is paused after the canary wave
+		{name: "paused", threshold: 0.5, status: utils.RolloutPaused, wave: 0, results: 1},
+		// Failed part is not greater than the threshold, canary, 50% and 100% waves are done
+		{name: "completed", threshold: 1, status: utils.RolloutCompleted, wave: 3, results: 4},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			sha256 := newRolloutTest(t)
+			created, err := utils.CreateRollout(utils.RolloutRequest{
+				Canary: []string{"rollout1"}, Percentages: []int{50}, FailureThreshold: tc.threshold, Nodes: rolloutHosts,
+			})
+			if err != nil {
+				t.Fatalf("Error creating rollout: %s", err)
+			}
+			pkg := created.Packages[utils.PackageDeb]
+			if created.Version != "2.1.0p14" || pkg.Sha256 != sha256 || !strings.HasSuffix(pkg.Path, "check-mk-agent_2.1.0p14-1_all.deb") {
+				t.Errorf("Expected the pinned package of 2.1.0p14, got %s %v", created.Version, created.Packages)
+			}
+
+			rollout := waitRollout(t, created.Id)
+			if rollout.Status != tc.status || rollout.CurrentWave != tc.wave {
+				t.Errorf("Expected %s at wave %d, got %s at wave %d", tc.status, tc.wave, rollout.Status, rollout.CurrentWave)
+			}
+			if tc.status == utils.RolloutPaused && !strings.Contains(rollout.Error, "1 of 1 nodes failed in wave canary") {
+				t.Errorf("Expected the failed canary wave in the error, got %q", rollout.Error)
+			}
+			results := 0
+			for _, wave := range rollout.Waves {
+				for _, result := range wave.Results {
+					results++
+					if result.Success || result.Error != "node is not available" {
+						t.Errorf("Expected the unavailable node failed, got %v", result)
+					}
+				}
+			}
+			if results != tc.results {
+				t.Errorf("Expected %d upgraded nodes, got %d", tc.results, results)
+			}
+		})
+	}
+}
+
+func TestCreateRolloutRejected(t *testing.T) {
+	newRolloutTest(t)
+	_, err := utils.CreateRollout(utils.RolloutRequest{Canary: []string{"missing"}, Nodes: rolloutHosts})
+	if err == nil || !strings.Contains(err.Error(), "unknown canary node missing") {
+		t.Errorf("Expected error for the unknown canary node, got %v", err)
+	}
+
+	utils.Rollouts.Mutex.Lock()
+	utils.Rollouts.Rollouts["running"] = &utils.Rollout{Id: "running", Status: utils.RolloutRunning}
+	utils.Rollouts.Rollouts["paused"] = &utils.Rollout{Id: "paused", Status: utils.RolloutPaused,
+		Packages: utils.AgentPackages{utils.PackageDeb: {Path: "agent.deb"}}}
+	utils.Rollouts.Mutex.Unlock()
+	_, err = utils.CreateRollout(utils.RolloutRequest{Canary: []string{"rollout1"}, Nodes: rolloutHosts})
+	if err == nil || !strings.Contains(err.Error(), "rollout running is running") {
+		t.Errorf("Expected error while the other rollout is running, got %v", err)
+	}
+	if err = utils.ResumeRollout("paused"); err == nil {
+		t.Errorf("Expected error resuming while the other rollout is running")
+	}
+	if len(utils.Rollouts.List()) != 2 {
+		t.Errorf("Expected no new rollout, got %v", utils.Rollouts.List())
+	}
+}
+
+// TestContinueRolloutAfterRestart The running rollout is continued from the saved wave
+// and the nodes with results are not upgraded again
+func TestContinueRolloutAfterRestart(t *testing.T) {
+	sha256 := newRolloutTest(t)
+	packages := utils.AgentPackages{utils.PackageDeb: {
+		Format:  utils.PackageDeb,
+		Path:    filepath.Join(config.ConfigCmkGetter.AgentPackageFolder, "check-mk-agent_2.1.0p14-1_all.deb"),
+		Version: "2.1.0p14",
+		Sha256:  sha256,
+	}}
+	canary := utils.RolloutWave{Name: "canary", Hosts: []string{"rollout1"}, Done: true,
+		Results: map[string]utils.RolloutNodeResult{"rollout1": {Host: "rollout1", Success: true, Version: "2.1.0p14"}}}
+	rest := utils.RolloutWave{Name: "100%", Hosts: []string{"rollout2", "rollout3"},
+		Results: map[string]utils.RolloutNodeResult{"rollout2": {Host: "rollout2", Success: true, Version: "2.1.0p14"}}}
+	saved := map[string]*utils.Rollout{
+		"saved": {Id: "saved", Version: "2.1.0p14", Packages: packages, Status: utils.RolloutRunning,
+			Waves: []utils.RolloutWave{canary, rest}, CurrentWave: 1},
+		"unpinned": {Id: "unpinned", Version: "2.1.0p14", Status: utils.RolloutRunning,
+			Waves: []utils.RolloutWave{canary}},
+	}
+	if err := utils.SaveState("rollouts", saved); err != nil {
+		t.Fatal(err)
+	}
+
+	running, err := utils.LoadRollouts()
+	if err != nil {
+		t.Fatalf("Error loading rollouts: %s", err)
+	}
+	if len(running) != 1 || running[0] != "saved" {
+		t.Fatalf("Expected the pinned rollout running, got %v", running)
+	}
+	if unpinned, _ := utils.Rollouts.Get("unpinned"); unpinned.Status != utils.RolloutPaused {
+		t.Errorf("Expected the rollout without pinned package paused, got %s", unpinned.Status)
+	}
+
+	utils.ContinueRollouts(running)
+	rollout := waitRollout(t, "saved")
+	if rollout.Status != utils.RolloutPaused || rollout.CurrentWave != 1 {
+		t.Errorf("Expected paused at the saved wave, got %s at wave %d", rollout.Status, rollout.CurrentWave)
+	}
+	if result := rollout.Waves[0].Results["rollout1"]; !result.Success {
+		t.Errorf("Expected the canary result kept, got %v", result)
+	}
+	if result := rollout.Waves[1].Results["rollout2"]; !result.Success {
+		t.Errorf("Expected the saved result of rollout2 kept, got %v", result)
+	}
+	if result := rollout.Waves[1].Results["rollout3"]; result.Success || result.Error != "node is not available" {
+		t.Errorf("Expected rollout3 upgraded after the restart, got %v", result)
+	}
+}
@@ -0,0 +1,52 @@
+package test
+
+import (
+	"cmk_getter/config"
+	"cmk_getter/utils"
+	"strings"
+	"testing"
+)
+
+func TestThresholdState(t *testing.T) {
+	tests := []struct {
+		value, warn, crit, expected int
+	}{
+		{0, 1, 5, utils.StateOk},
+		{1, 1, 5, utils.StateWarn},
+		{5, 1, 5, utils.StateCrit},
+		{5, -1, -1, utils.StateOk},
+	}
+	for _, test := range tests {
+		if state := utils.ThresholdState(test.value, test.warn, test.crit); state != test.expected {
+			t.Errorf("Expected state %d for %v, got %d", test.expected, test, state)
+		}
+	}
+}
+
+func TestSelfCheckOutput(t *testing.T) {
+	config.ConfigCmkGetter.SelfCheck.Piggyback = true
+	defer func() {
+		config.ConfigCmkGetter.SelfCheck.Piggyback = false
+	}()
+	nodes := []utils.CheckMkNode{
+		{Host: "node1", IsAvailable: true, Plugins: []utils.CheckMkPlugin{
+			{Name: "mk_apache", Status: utils.PluginDrifted},
+			{Name: "mk_mysql", Status: utils.PluginDeployed},
+		}},
+		{Host: "node2"},
+	}
+	output := utils.SelfCheckOutput(nodes)
+	expected := []string{
+		"<<<local:sep(0)>>>\n",
+		"1 \"cmk_getter SSH nodes\" unreachable=1;1;5|nodes=2;; 1 of 2 nodes unreachable by SSH: node2\n",
+		"1 \"cmk_getter plugins\" drifted=1;1;10|failing=0;; 1 drifted, 0 failing plugins\n",
+		"<<<<node1>>>>\n<<<local:sep(0)>>>\n0 \"cmk_getter SSH\" - SSH is available for cmk_getter\n" +
+			"1 \"cmk_getter plugins\" drifted=1;1;10|failing=0;; 1 drifted, 0 failing plugins, drifted: mk_apache\n<<<<>>>>\n",
+		"<<<<node2>>>>\n<<<local:sep(0)>>>\n2 \"cmk_getter SSH\" - SSH is not available for cmk_getter\n",
+	}
+	for _, line := range expected {
+		if !strings.Contains(output, line) {
+			t.Errorf("Expected %q in the output:\n%s", line, output)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package test
+
+import (
+	"cmk_getter/config"
+	"cmk_getter/utils"
+	"github.com/pkg/sftp"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newSftpClient Return the sftp client of the in-process server with the local file system
+func newSftpClient(t *testing.T) *sftp.Client {
+	clientConn, serverConn := net.Pipe()
+	server, err := sftp.NewServer(serverConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = server.Serve()
+	}()
+	client, err := sftp.NewClientPipe(clientConn, clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return client
+}
+
+// newTestNode Return the node with the plugin and local folders in the temporary folder
+// The data folder and the owner of the plugins are set for the test
+func newTestNode(t *testing.T) utils.CheckMkNode {
+	dir := t.TempDir()
+	saved := config.ConfigCmkGetter
+	config.ConfigCmkGetter.DataFolder = filepath.Join(dir, "data")
+	config.ConfigCmkGetter.PluginUid = os.Getuid()
+	config.ConfigCmkGetter.PluginGid = os.Getgid()
+	t.Cleanup(func() {
+		config.ConfigCmkGetter = saved
+	})
+	return utils.CheckMkNode{
+		Host:         "node1",
+		PluginFolder: filepath.Join(dir, "plugins"),
+		LocalFolder:  filepath.Join(dir, "local"),
+		IsAvailable:  true,
+	}
+}
+
+// newTestPlugin Return the plugin with the content and its hashes
+func newTestPlugin(name, content string) utils.CheckMkPlugin {
+	c := utils.CheckMkPlugin{Name: name, ByteContent: []byte(content)}
+	c.Sha256 = c.CalculateSha256()
+	return c
+}
+
+// writeTestFile Write the file creating its folder
+func writeTestFile(t *testing.T, path, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readTestFile Return the content of the file, empty if it does not exist
+func readTestFile(t *testing.T, path string) string {
+	content, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return string(content)
+}
@@ -0,0 +1,345 @@
+package test
+
+import (
+	"cmk_getter/config"
+	"cmk_getter/utils"
+	"errors"
+	"github.com/pkg/sftp"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestGetPluginFolderFor(t *testing.T) {
+	node := utils.CheckMkNode{Host: "node1", PluginFolder: "/usr/lib/check_mk_agent/plugins", LocalFolder: "/usr/lib/check_mk_agent/local"}
+	cases := []struct {
+		plugin   utils.CheckMkPlugin
+		expected string
+	}{
+		{utils.CheckMkPlugin{Name: "mk_apache"}, "/usr/lib/check_mk_agent/plugins"},
+		{utils.CheckMkPlugin{Name: "mk_apache", Interval: 300}, "/usr/lib/check_mk_agent/plugins/300"},
+		{utils.CheckMkPlugin{Name: "check_disk", Kind: utils.KindLocal}, "/usr/lib/check_mk_agent/local"},
+		{utils.CheckMkPlugin{Name: "check_disk", Kind: utils.KindLocal, Interval: 60}, "/usr/lib/check_mk_agent/local/60"},
+	}
+	for _, tc := range cases {
+		if folder := node.GetPluginFolderFor(tc.plugin); folder != tc.expected {
+			t.Errorf("Expected %s for %v, got %s", tc.expected, tc.plugin, folder)
+		}
+		if path := node.GetPluginPath(tc.plugin); path != tc.expected+"/"+tc.plugin.Name {
+			t.Errorf("Expected %s/%s, got %s", tc.expected, tc.plugin.Name, path)
+		}
+	}
+}
+
+// TestCleanupPluginCopies The copies of the plugin in the other interval folders are removed when the interval is changed
+func TestCleanupPluginCopies(t *testing.T) {
+	cases := []struct {
+		name     string
+		interval int
+		// Files with the plugin before the send, relative to the plugin folder
+		copies []string
+	}{
+		{name: "interval added", interval: 300, copies: []string{"mk_test"}},
+		{name: "interval changed", interval: 600, copies: []string{"300/mk_test", "mk_test"}},
+		{name: "interval removed", interval: 0, copies: []string{"300/mk_test", "600/mk_test"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			node := newTestNode(t)
+			client := newSftpClient(t)
+			for _, file := range tc.copies {
+				writeTestFile(t, filepath.Join(node.PluginFolder, file), "old")
+			}
+			// Other plugin in the interval folder is kept
+			other := filepath.Join(node.PluginFolder, "300", "mk_other")
+			writeTestFile(t, other, "other")
+
+			c := newTestPlugin("mk_test", "new")
+			c.Interval = tc.interval
+			if _, err := node.SendPluginFile(nil, client, c); err != nil {
+				t.Fatalf("Error sending plugin: %s", err)
+			}
+			if content := readTestFile(t, node.GetPluginPath(c)); content != "new" {
+				t.Errorf("Expected the plugin in %s, got %q", node.GetPluginFolderFor(c), content)
+			}
+			for _, file := range tc.copies {
+				path := filepath.Join(node.PluginFolder, file)
+				if path == node.GetPluginPath(c) {
+					continue
+				}
+				if _, err := os.Stat(path); !os.IsNotExist(err) {
+					t.Errorf("Expected the copy %s removed, got %v", file, err)
+				}
+			}
+			if content := readTestFile(t, other); content != "other" {
+				t.Errorf("Expected the other plugin kept, got %q", content)
+			}
+		})
+	}
+}
+
+// renameClient Sftp client of the server without posix-rename, the rename of failPath fails
+type renameClient struct {
+	*sftp.Client
+	failPath string
+}
+
+func (c renameClient) HasExtension(string) (string, bool) {
+	return "", false
+}
+
+func (c renameClient) Rename(oldPath, newPath string) error {
+	if oldPath == c.failPath {
+		return errors.New("rename failed")
+	}
+	return c.Client.Rename(oldPath, newPath)
+}
+
+func TestRenameRemoteFileWithoutPosixRename(t *testing.T) {
+	cases := []struct {
+		name     string
+		existing string
+		fails    bool
+		expected string
+	}{
+		{name: "replace", existing: "old", expected: "new"},
+		{name: "create", expected: "new"},
+		{name: "rename fails", existing: "old", fails: true, expected: "old"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			tmpPath := filepath.Join(dir, ".mk_test.cmk_getter.tmp")
+			pluginPath := filepath.Join(dir, "mk_test")
+			writeTestFile(t, tmpPath, "new")
+			if tc.existing != "" {
+				writeTestFile(t, pluginPath, tc.existing)
+			}
+			client := renameClient{Client: newSftpClient(t)}
+			if tc.fails {
+				client.failPath = tmpPath
+			}
+
+			err := utils.RenameRemoteFile(client, tmpPath, pluginPath)
+			if tc.fails != (err != nil) {
+				t.Errorf("Expected error %v, got %v", tc.fails, err)
+			}
+			if content := readTestFile(t, pluginPath); content != tc.expected {
+				t.Errorf("Expected %q in the plugin file, got %q", tc.expected, content)
+			}
+			entries, _ := os.ReadDir(dir)
+			for _, entry := range entries {
+				if entry.Name() != "mk_test" && entry.Name() != filepath.Base(tmpPath) {
+					t.Errorf("Expected no other files, got %s", entry.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestFindUnmanagedPlugins(t *testing.T) {
+	files := map[string]string{
+		"plugins/mk_apache":       "managed",
+		"plugins/mk_apache.bak":   "backup",
+		"plugins/mk_old":          "unmanaged",
+		"plugins/300/mk_async":    "managed in the interval folder",
+		"plugins/mk_async":        "managed plugin in the wrong folder",
+		"plugins/600/mk_apache":   "copy in the interval folder",
+		"plugins/600/mk_old":      "unmanaged in the interval folder",
+		"plugins/cache/mk_cached": "not an interval folder",
+		"local/check_disk":        "managed",
+		"local/check_old":         "unmanaged",
+		"local/60/check_async":    "managed in the interval folder",
+	}
+	cases := []struct {
+		name   string
+		remove bool
+		kind   string
+		// Expected unmanaged files relative to the base folder
+		expected []string
+		// Expected files in the base folder after the check
+		kept []string
+		// Expected unmanaged files removed from the node
+		removed []string
+	}{
+		{name: "plugins", kind: utils.KindPlugin,
+			expected: []string{"600/mk_apache", "600/mk_old", "mk_async", "mk_old"},
+			kept:     []string{"600/mk_apache", "600/mk_old", "mk_async", "mk_old", "mk_apache", "300/mk_async"}},
+		{name: "local checks", kind: utils.KindLocal,
+			expected: []string{"check_old"},
+			kept:     []string{"check_old", "check_disk", "60/check_async"}},
+		{name: "remove plugins", kind: utils.KindPlugin, remove: true,
+			kept:    []string{"mk_apache", "mk_apache.bak", "300/mk_async", "cache/mk_cached"},
+			removed: []string{"600/mk_apache", "600/mk_old", "mk_async", "mk_old"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			node := newTestNode(t)
+			config.ConfigCmkGetter.RemoveUnmanagedPlugins = tc.remove
+			node.Plugins = []utils.CheckMkPlugin{{Name: "mk_apache"}, {Name: "mk_async", Interval: 300}}
+			node.LocalChecks = []utils.CheckMkPlugin{
+				{Name: "check_disk", Kind: utils.KindLocal},
+				{Name: "check_async", Kind: utils.KindLocal, Interval: 60},
+			}
+			root := filepath.Dir(node.PluginFolder)
+			for path, content := range files {
+				writeTestFile(t, filepath.Join(root, path), content)
+			}
+
+			unmanaged, err := node.FindUnmanagedPlugins(newSftpClient(t), tc.kind)
+			if err != nil {
+				t.Fatalf("Error finding unmanaged plugins: %s", err)
+			}
+			sort.Strings(unmanaged)
+			if !reflect.DeepEqual(unmanaged, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, unmanaged)
+			}
+			for _, file := range tc.kept {
+				if _, err := os.Stat(filepath.Join(node.GetBaseFolder(tc.kind), file)); err != nil {
+					t.Errorf("Expected %s kept, got %v", file, err)
+				}
+			}
+			for _, file := range tc.removed {
+				if _, err := os.Stat(filepath.Join(node.GetBaseFolder(tc.kind), file)); !os.IsNotExist(err) {
+					t.Errorf("Expected %s removed, got %v", file, err)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckArtifactsLocalChecks(t *testing.T) {
+	node := newTestNode(t)
+	root := filepath.Dir(node.PluginFolder)
+	config.ConfigCmkGetter.LocalChecksFolder = filepath.Join(root, "source", "local")
+	// Plugin with the name of the local check is not used for it
+	config.ConfigCmkGetter.PluginsFolder = filepath.Join(root, "source", "plugins")
+	writeTestFile(t, filepath.Join(config.ConfigCmkGetter.PluginsFolder, "check_disk"), "plugin")
+
+	sources := map[string]string{
+		"check_disk":    "disk",
+		"check_async":   "async",
+		"check_moved":   "moved",
+		"check_changed": "new",
+		"check_failing": "failing",
+	}
+	onNode := map[string]string{
+		"check_disk":     "disk",
+		"60/check_async": "async",
+		// Interval is set, the file in the base folder is not used
+		"check_moved":   "moved",
+		"check_changed": "old",
+		"check_failing": "failing",
+	}
+	for name, content := range sources {
+		writeTestFile(t, filepath.Join(config.ConfigCmkGetter.LocalChecksFolder, name), content)
+	}
+	for path, content := range onNode {
+		writeTestFile(t, filepath.Join(node.LocalFolder, path), content)
+	}
+	failed := &utils.PluginVerification{Success: false}
+	artifacts := []utils.CheckMkPlugin{
+		{Name: "check_disk", Kind: utils.KindLocal},
+		{Name: "check_async", Kind: utils.KindLocal, Interval: 60},
+		{Name: "check_moved", Kind: utils.KindLocal, Interval: 60},
+		{Name: "check_changed", Kind: utils.KindLocal},
+		{Name: "check_failing", Kind: utils.KindLocal, Verification: failed},
+		{Name: "check_missing", Kind: utils.KindLocal},
+	}
+	expected := map[string]string{
+		"check_disk":    utils.PluginDeployed,
+		"check_async":   utils.PluginDeployed,
+		"check_moved":   utils.PluginDrifted,
+		"check_changed": utils.PluginDrifted,
+		"check_failing": utils.PluginFailing,
+		"check_missing": utils.PluginDrifted,
+	}
+
+	checked := node.CheckArtifacts(nil, newSftpClient(t), artifacts)
+	if len(checked) != len(artifacts) {
+		t.Fatalf("Expected %d local checks, got %d", len(artifacts), len(checked))
+	}
+	for _, c := range checked {
+		if c.Status != expected[c.Name] {
+			t.Errorf("Expected %s %s, got %s", c.Name, expected[c.Name], c.Status)
+		}
+		if c.Status == utils.PluginDeployed && (c.Sha256 != utils.Sha256Hex([]byte(sources[c.Name])) || c.NodeSha256 != c.Sha256) {
+			t.Errorf("Expected sha256 of the local check source on %s, got %s %s", c.Name, c.Sha256, c.NodeSha256)
+		}
+	}
+	if artifacts[0].Status != "" || artifacts[0].Sha256 != "" {
+		t.Errorf("Expected the list of the node unchanged, got %v", artifacts[0])
+	}
+}
+
+func TestStatPluginFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "mk_test")
+	writeTestFile(t, path, "node")
+	modTime := time.Date(2023, 5, 10, 8, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	client := newSftpClient(t)
+	c := newTestPlugin("mk_test", "same")
+	cases := []struct {
+		name     string
+		path     string
+		plugin   utils.CheckMkPlugin
+		previous utils.CheckMkPlugin
+		exists   bool
+		expected string
+	}{
+		{name: "missing file", path: filepath.Join(dir, "missing"), plugin: c},
+		{name: "hashed", path: path, plugin: c, exists: true, expected: utils.Sha256Hex([]byte("node"))},
+		{name: "previous hash reused", path: path, plugin: c, exists: true, expected: "previous",
+			previous: utils.CheckMkPlugin{NodeSha256: "previous", NodeSize: 4, NodeModTime: modTime}},
+		{name: "changed modification time", path: path, plugin: c, exists: true, expected: utils.Sha256Hex([]byte("node")),
+			previous: utils.CheckMkPlugin{NodeSha256: "previous", NodeSize: 4, NodeModTime: modTime.Add(time.Second)}},
+		{name: "changed size", path: path, plugin: c, exists: true, expected: utils.Sha256Hex([]byte("node")),
+			previous: utils.CheckMkPlugin{NodeSha256: "previous", NodeSize: 5, NodeModTime: modTime}},
+		{name: "size differs from the source", path: path, plugin: newTestPlugin("mk_test", "longer"), exists: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			state, err := utils.StatPluginFile(nil, client, tc.path, tc.plugin, tc.previous)
+			if err != nil {
+				t.Fatalf("Error reading plugin file: %s", err)
+			}
+			if state.Exists != tc.exists || state.Sha256 != tc.expected {
+				t.Errorf("Expected exists %v with sha256 %q, got %v", tc.exists, tc.expected, state)
+			}
+			if tc.exists && (state.Size != 4 || !state.ModTime.Equal(modTime)) {
+				t.Errorf("Expected size and modification time of the file, got %v", state)
+			}
+		})
+	}
+}
+
+// TestCheckArtifactsSourceUnavailable The state of the plugin is kept if its source can not be read,
+// so an outage of the Check_MK server does not report drift on every node
+func TestCheckArtifactsSourceUnavailable(t *testing.T) {
+	node := newTestNode(t)
+	root := filepath.Dir(node.PluginFolder)
+	config.ConfigCmkGetter.PluginsFolder = filepath.Join(root, "source")
+	writeTestFile(t, filepath.Join(config.ConfigCmkGetter.PluginsFolder, "mk_pinned"), "pinned")
+	writeTestFile(t, filepath.Join(node.PluginFolder, "mk_pinned"), "pinned")
+	writeTestFile(t, filepath.Join(node.PluginFolder, "mk_apache"), "apache")
+
+	sha256 := utils.Sha256Hex([]byte("apache"))
+	deployed := utils.CheckMkPlugin{Name: "mk_apache", Source: utils.SourceLocal, IsActual: true, Status: utils.PluginDeployed,
+		Sha256: sha256, NodeSha256: sha256, NodeSize: 6}
+	pinned := utils.CheckMkPlugin{Name: "mk_pinned", Source: utils.SourceLocal, IsActual: true, Status: utils.PluginDeployed,
+		PinnedSha256: utils.Sha256Hex([]byte("other"))}
+
+	checked := node.CheckArtifacts(nil, newSftpClient(t), []utils.CheckMkPlugin{deployed, pinned})
+	if checked[0].Status != utils.PluginDeployed || !checked[0].IsActual || checked[0].Sha256 != sha256 || checked[0].NodeSha256 != sha256 {
+		t.Errorf("Expected the previous state of the plugin without source, got %v", checked[0])
+	}
+	if checked[1].Status != utils.PluginDrifted {
+		t.Errorf("Expected drift of the plugin with the checksum mismatch, got %s", checked[1].Status)
+	}
+}
@@ -0,0 +1,403 @@
+package utils
+
+import (
+	"cmk_getter/config"
+	"cmk_getter/log"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Formats of the agent package
+const (
+	PackageDeb = "deb"
+	PackageRpm = "rpm"
+)
+
+// AgentPackageFormats Formats of the agent packages downloaded from Check_MK
+var AgentPackageFormats = []string{PackageDeb, PackageRpm}
+
+// AgentInstallResult Result of the agent package installation on the node
+type AgentInstallResult struct {
+	Time    time.Time `json:"time"`
+	Package string    `json:"package"`
+	Version string    `json:"version"`
+	Success bool      `json:"success"`
+	Output  string    `json:"output"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// agentVersionRegexp Version from check_mk_agent --version output
+var agentVersionRegexp = regexp.MustCompile(`(\d+\.\d+\.\d+[a-z0-9]*)`)
+
+// releaseSuffixRegexp Package release suffix like -1 in 2.1.0p14-1
+var releaseSuffixRegexp = regexp.MustCompile(`-\d+$`)
+
+// packageVersionRegexps Version in the file name of the downloaded agent package by format
+var packageVersionRegexps = map[string]*regexp.Regexp{
+	PackageDeb: regexp.MustCompile(`^check-mk-agent_(.+)-\d+_all\.deb$`),
+	PackageRpm: regexp.MustCompile(`^check-mk-agent-(.+)-\d+\.noarch\.rpm$`),
+}
+
+// AgentPackage Downloaded agent package file with its version and sha256
+type AgentPackage struct {
+	Format  string `json:"format"`
+	Path    string `json:"path"`
+	Version string `json:"version"`
+	Sha256  string `json:"sha256"`
+}
+
+// AgentPackages Pinned agent packages by format
+type AgentPackages map[string]AgentPackage
+
+// AgentPackageName Return the file name of the agent package downloaded from Check_MK
+func AgentPackageName(format, version string) string {
+	if format == PackageRpm {
+		return "check-mk-agent-" + version + "-1.noarch.rpm"
+	}
+	return "check-mk-agent_" + version + "-1_all.deb"
+}
+
+// LatestAgentPackageName Return the name of the symlink to the latest agent package
+func LatestAgentPackageName(format string) string {
+	return "check-mk-agent-latest." + format
+}
+
+// PackageVersion Return the agent version from the package file name, empty if the name is not known
+func PackageVersion(format, name string) string {
+	packageRegexp, ok := packageVersionRegexps[format]
+	if !ok {
+		return ""
+	}
+	match := packageRegexp.FindStringSubmatch(name)
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+// LatestAgentPackage Return the package linked by check-mk-agent-latest.<format> in the package folder
+// The symlink is resolved, so the package stays the same when the symlink is moved to a new version
+func LatestAgentPackage(format string) (AgentPackage, error) {
+	packagePath, err := filepath.EvalSymlinks(filepath.Join(GetAgentPackageFolder(), LatestAgentPackageName(format)))
+	if err != nil {
+		return AgentPackage{}, err
+	}
+	content, err := os.ReadFile(packagePath)
+	if err != nil {
+		return AgentPackage{}, err
+	}
+	return AgentPackage{
+		Format:  format,
+		Path:    packagePath,
+		Version: PackageVersion(format, filepath.Base(packagePath)),
+		Sha256:  Sha256Hex(content),
+	}, nil
+}
+
+// LatestAgentPackages Return the latest downloaded packages of the same version by format
+// The version of the first found format is used, packages of the other versions are skipped
+func LatestAgentPackages() (AgentPackages, error) {
+	packages := AgentPackages{}
+	version := ""
+	for _, format := range AgentPackageFormats {
+		pkg, err := LatestAgentPackage(format)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(packages) > 0 && pkg.Version != version {
+			log.Logger.Infoln("Agent package", pkg.Path, "is skipped, the version is not", version)
+			continue
+		}
+		version = pkg.Version
+		packages[format] = pkg
+	}
+	if len(packages) == 0 {
+		return nil, fmt.Errorf("no agent package in %s", GetAgentPackageFolder())
+	}
+	return packages, nil
+}
+
+// Version Return the version of the packages
+func (p AgentPackages) Version() string {
+	for _, pkg := range p {
+		return pkg.Version
+	}
+	return ""
+}
+
+// ReadAgentPackage Read the package file and check that it is not changed since it was pinned
+func ReadAgentPackage(pkg AgentPackage) ([]byte, error) {
+	if pkg.Path == "" {
+		return nil, fmt.Errorf("no agent package")
+	}
+	content, err := os.ReadFile(pkg.Path)
+	if err != nil {
+		return nil, err
+	}
+	if sha256 := Sha256Hex(content); sha256 != pkg.Sha256 {
+		return nil, fmt.Errorf("sha256 of %s is %s, expected %s", pkg.Path, sha256, pkg.Sha256)
+	}
+	return content, nil
+}
+
+// GetAgentPackageFolder Return folder with the downloaded agent packages
+func GetAgentPackageFolder() string {
+	if config.ConfigCmkGetter.AgentPackageFolder != "" {
+		return config.ConfigCmkGetter.AgentPackageFolder
+	}
+	if len(config.ConfigCmkGetter.Folders) > 0 {
+		return config.ConfigCmkGetter.Folders[0]
+	}
+	return "."
+}
+
+// NormalizeAgentVersion Crop the package release and spaces from the agent version
+func NormalizeAgentVersion(version string) string {
+	version = strings.TrimSpace(version)
+	return releaseSuffixRegexp.ReplaceAllString(version, "")
+}
+
+// IsActualAgentVersion Check if the agent version is the same as CurrentVersion
+func IsActualAgentVersion(version string) bool {
+	return version != "" && version == CurrentVersion
+}
+
+// detectPackageFormat Return deb if dpkg is on the node, rpm if rpm is on the node
+func detectPackageFormat(sshClient *ssh.Client) (string, error) {
+	managers := []struct {
+		command string
+		format  string
+	}{
+		{"command -v dpkg", PackageDeb},
+		{"command -v rpm", PackageRpm},
+	}
+	for _, manager := range managers {
+		_, _, exitCode, err := RunCommand(sshClient, manager.command)
+		if err != nil {
+			return "", err
+		}
+		if exitCode == 0 {
+			return manager.format, nil
+		}
+	}
+	return "", fmt.Errorf("no dpkg or rpm on the node")
+}
+
+// installCommand Return the command installing the package file of the format
+// The same version is installed again with rpm --replacepkgs like with dpkg -i
+func installCommand(format, packagePath string) string {
+	if format == PackageRpm {
+		return "rpm -U --replacepkgs " + ShellQuote(packagePath)
+	}
+	return "dpkg -i " + ShellQuote(packagePath)
+}
+
+// ParseTempDir Return the directory from the mktemp -d output
+// The directory must be an absolute path without spaces to be used in the commands
+func ParseTempDir(stdout string) (string, error) {
+	dir := strings.TrimSpace(stdout)
+	if !strings.HasPrefix(dir, "/") || strings.ContainsAny(dir, " \t\n'\"") {
+		return "", fmt.Errorf("bad temporary directory %q", dir)
+	}
+	return dir, nil
+}
+
+// createRemoteTempDir Create the private temporary directory on the node with mktemp -d
+// The directory is accessible only by the ssh user, so other users can not replace the package
+func createRemoteTempDir(sshClient *ssh.Client) (string, error) {
+	stdout, stderr, exitCode, err := RunCommand(sshClient, "mktemp -d /tmp/cmk_getter.XXXXXXXX")
+	if err != nil {
+		return "", err
+	}
+	if exitCode != 0 {
+		return "", fmt.Errorf("mktemp exited with code %d: %s", exitCode, strings.TrimSpace(stderr))
+	}
+	return ParseTempDir(stdout)
+}
+
+// detectAgentVersion Return installed agent version from the package manager or check_mk_agent --version
+func detectAgentVersion(sshClient *ssh.Client) (string, error) {
+	commands := []string{
+		"dpkg-query -W -f='${Version}' check-mk-agent",
+		"rpm -q --qf '%{VERSION}' check-mk-agent",
+	}
+	for _, command := range commands {
+		stdout, _, exitCode, err := RunCommand(sshClient, command)
+		if err != nil {
+			return "", err
+		}
+		if exitCode == 0 && strings.TrimSpace(stdout) != "" {
+			return NormalizeAgentVersion(stdout), nil
+		}
+	}
+	stdout, _, exitCode, err := RunCommand(sshClient, "check_mk_agent --version")
+	if err != nil {
+		return "", err
+	}
+	if exitCode == 0 {
+		if version := agentVersionRegexp.FindString(stdout); version != "" {
+			return version, nil
+		}
+	}
+	return "", fmt.Errorf("check_mk agent is not installed")
+}
+
+// DetectAgentVersion Return the agent version installed on the node
+func (node CheckMkNode) DetectAgentVersion() (string, error) {
+	sshClient, err := node.CreateSshClient()
+	if err != nil {
+		log.WithNode(node.Host).Debugln("Error creating ssh client:", err)
+		return "", err
+	}
+	defer func() {
+		_ = sshClient.Close()
+	}()
+	return detectAgentVersion(sshClient)
+}
+
+// InstallAgent Upload the latest agent package to the node and install it with dpkg or rpm
+// The result is saved to the node in the CheckMkNodeMap
+func (node CheckMkNode) InstallAgent() AgentInstallResult {
+	packages, err := LatestAgentPackages()
+	if err != nil {
+		result := AgentInstallResult{Time: time.Now(), Error: err.Error()}
+		log.WithNode(node.Host).Infoln("Error installing agent on", node.Host+":", result.Error)
+		return result
+	}
+	return node.InstallAgentPackages(packages)
+}
+
+// InstallAgentPackages Upload the agent package of the node format to the node and install it
+// The result is saved to the node in the CheckMkNodeMap
+func (node CheckMkNode) InstallAgentPackages(packages AgentPackages) AgentInstallResult {
+	result := node.installAgent(packages)
+	if result.Success {
+		log.WithNode(node.Host).Infoln("Agent", result.Version, "installed on", node.Host)
+	} else {
+		log.WithNode(node.Host).Infoln("Error installing agent on", node.Host+":", result.Error)
+	}
+	CheckMkNodeMap.UpdateNode(node.Host, func(n *CheckMkNode) {
+		n.LastAgentInstall = &result
+		if result.Success {
+			n.AgentVersion = result.Version
+			n.IsAgentActual = IsActualAgentVersion(result.Version)
+		}
+	})
+	return result
+}
+
+func (node CheckMkNode) installAgent(packages AgentPackages) AgentInstallResult {
+	result := AgentInstallResult{Time: time.Now()}
+	sshClient, sftpClient, err := node.CreateSftpClient()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer func() {
+		_ = sftpClient.Close()
+		_ = sshClient.Close()
+	}()
+	result.Package, err = detectPackageFormat(sshClient)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	pkg, ok := packages[result.Package]
+	if !ok {
+		result.Error = fmt.Sprintf("no %s package of the agent", result.Package)
+		return result
+	}
+	packageName := filepath.Base(pkg.Path)
+	content, err := ReadAgentPackage(pkg)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	// Upload the package to the private temporary directory on the node
+	tempDir, err := createRemoteTempDir(sshClient)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer func() {
+		_, _, _, _ = RunCommand(sshClient, "rm -rf -- "+ShellQuote(tempDir))
+	}()
+	remotePath := tempDir + "/" + packageName
+	remoteFile, err := sftpClient.Create(remotePath)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	_, err = remoteFile.Write(content)
+	closeErr := remoteFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	// Check the uploaded package before it is installed as root
+	sha256, err := remoteSha256(sshClient, remotePath)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if sha256 != Sha256Hex(content) {
+		result.Error = fmt.Sprintf("sha256 of the uploaded package %s is different from the downloaded %s", sha256, Sha256Hex(content))
+		return result
+	}
+	// Install the package
+	command := installCommand(result.Package, remotePath)
+	stdout, stderr, exitCode, err := RunCommand(sshClient, command)
+	result.Output = stdout + stderr
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if exitCode != 0 {
+		result.Error = fmt.Sprintf("%s exited with code %d", command, exitCode)
+		return result
+	}
+	result.Version, err = detectAgentVersion(sshClient)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Success = true
+	return result
+}
+
+// AgentVerifyTimeout Timeout of the agent run for the verification
+const AgentVerifyTimeout = 60 * time.Second
+
+// VerifyAgent Run check_mk_agent on the node and check the <<<check_mk>>> section in the output
+func (node CheckMkNode) VerifyAgent() error {
+	sshClient, err := node.CreateSshClient()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = sshClient.Close()
+	}()
+	stdout, stderr, exitCode, err := RunCommandTimeout(sshClient, "check_mk_agent", AgentVerifyTimeout)
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("check_mk_agent exited with code %d: %s", exitCode, strings.TrimSpace(stderr))
+	}
+	if !strings.Contains(stdout, "<<<check_mk>>>") {
+		return fmt.Errorf("no <<<check_mk>>> section in the agent output")
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package utils
+
+import (
+	"strings"
+)
+
+// AgentSection Section of the agent output with the lines after the <<<name>>> header
+type AgentSection struct {
+	Name      string   `json:"name"`
+	Options   string   `json:"options,omitempty"`
+	Piggyback string   `json:"piggyback,omitempty"`
+	Lines     []string `json:"lines"`
+}
+
+// AgentPluginSection Presence of the plugin section in the agent output
+type AgentPluginSection struct {
+	Plugin  string `json:"plugin"`
+	Section string `json:"section"`
+	Present bool   `json:"present"`
+}
+
+// AgentOutput Parsed output of check_mk_agent
+type AgentOutput struct {
+	Host     string               `json:"host"`
+	Version  string               `json:"version"`
+	OS       string               `json:"os"`
+	Hostname string               `json:"hostname"`
+	Sections []AgentSection       `json:"sections"`
+	Plugins  []AgentPluginSection `json:"plugins"`
+}
+
+// ParseAgentOutput Split the agent output to sections and read the agent info from <<<check_mk>>>
+// Sections after <<<<host>>>> belong to the piggyback host until <<<<>>>>
+func ParseAgentOutput(output string) AgentOutput {
+	result := AgentOutput{Sections: []AgentSection{}}
+	piggyback := ""
+	var current *AgentSection
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimRight(line, "\r")
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, "<<<<") && strings.HasSuffix(trimmed, ">>>>"):
+			piggyback = strings.TrimSuffix(strings.TrimPrefix(trimmed, "<<<<"), ">>>>")
+			current = nil
+		case strings.HasPrefix(trimmed, "<<<") && strings.HasSuffix(trimmed, ">>>"):
+			header := strings.SplitN(strings.TrimSuffix(strings.TrimPrefix(trimmed, "<<<"), ">>>"), ":", 2)
+			section := AgentSection{Name: header[0], Piggyback: piggyback, Lines: []string{}}
+			if len(header) > 1 {
+				section.Options = header[1]
+			}
+			result.Sections = append(result.Sections, section)
+			current = &result.Sections[len(result.Sections)-1]
+		case current != nil && line != "":
+			current.Lines = append(current.Lines, line)
+		}
+	}
+	// Agent info from the check_mk section of the host
+	for _, section := range result.Sections {
+		if section.Name != "check_mk" || section.Piggyback != "" {
+			continue
+		}
+		for _, line := range section.Lines {
+			key, value, found := strings.Cut(line, ":")
+			if !found {
+				continue
+			}
+			value = strings.TrimSpace(value)
+			switch key {
+			case "Version":
+				result.Version = value
+			case "AgentOS":
+				result.OS = value
+			case "Hostname":
+				result.Hostname = value
+			}
+		}
+	}
+	return result
+}
+
+// GetSection Return the section of the host by name
+func (o AgentOutput) GetSection(name string) (AgentSection, bool) {
+	for _, section := range o.Sections {
+		if section.Name == name && section.Piggyback == "" {
+			return section, true
+		}
+	}
+	return AgentSection{}, false
+}
+
+// CollectAgentOutput Run check_mk_agent on the node and parse the output
+// Plugins of the node are checked for their sections in the output
+func (node CheckMkNode) CollectAgentOutput() (AgentOutput, error) {
+	sshClient, err := node.CreateSshClient()
+	if err != nil {
+		return AgentOutput{}, err
+	}
+	defer func() {
+		_ = sshClient.Close()
+	}()
+	stdout, _, _, err := RunCommandTimeout(sshClient, "check_mk_agent", AgentVerifyTimeout)
+	if err != nil {
+		return AgentOutput{}, err
+	}
+	output := ParseAgentOutput(stdout)
+	output.Host = node.Host
+	output.Plugins = []AgentPluginSection{}
+	for _, plugin := range node.Plugins {
+		section := plugin.Section
+		if section == "" {
+			// Sections of the plugins are named like the plugin without the extension
+			section = strings.SplitN(plugin.Name, ".", 2)[0]
+		}
+		_, present := output.GetSection(section)
+		output.Plugins = append(output.Plugins, AgentPluginSection{
+			Plugin:  plugin.Name,
+			Section: section,
+			Present: present,
+		})
+	}
+	return output, nil
+}
@@ -0,0 +1,316 @@
+package utils
+
+import (
+	"bufio"
+	"cmk_getter/config"
+	"cmk_getter/log"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// auditFile Name of the append-only audit log in the data folder
+const auditFile = "audit.jsonl"
+
+// auditConfigState Name of the state file with the config seen on the last start
+const auditConfigState = "audit_config"
+
+// AuditActorAuto Actor of the actions started by cmk_getter itself
+const AuditActorAuto = "auto-remediation"
+
+// Actions of the audit log
+const (
+	AuditDeploy          = "deploy"
+	AuditRollback        = "rollback"
+	AuditRemove          = "remove"
+	AuditRemoveUnmanaged = "remove_unmanaged"
+	AuditAgentInstall    = "agent_install"
+	AuditAgentDownload   = "agent_download"
+	AuditPinChange       = "pin_change"
+	// AuditConfigChange config.yaml changed since the last start, the config is not reloaded while running
+	AuditConfigChange = "config_change"
+)
+
+// AuditEntry Mutating action saved to the audit log
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Action string    `json:"action"`
+	Host   string    `json:"host,omitempty"`
+	Kind   string    `json:"kind,omitempty"`
+	Name   string    `json:"name,omitempty"`
+	// Hashes of the plugin or the config before and after the action
+	OldSha256 string `json:"old_sha256,omitempty"`
+	NewSha256 string `json:"new_sha256,omitempty"`
+	Version   string `json:"version,omitempty"`
+	// Result of the action: ok, failed or the status of the deployed plugin
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// AuditFilter Filter of the audit entries, empty fields match any entry
+type AuditFilter struct {
+	Actor  string
+	Action string
+	Host   string
+	Name   string
+	Since  time.Time
+	Until  time.Time
+}
+
+// Match Check if the entry matches the filter
+func (f AuditFilter) Match(entry AuditEntry) bool {
+	switch {
+	case f.Actor != "" && entry.Actor != f.Actor:
+		return false
+	case f.Action != "" && entry.Action != f.Action:
+		return false
+	case f.Host != "" && entry.Host != f.Host:
+		return false
+	case f.Name != "" && entry.Name != f.Name:
+		return false
+	case !f.Since.IsZero() && entry.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && entry.Time.After(f.Until):
+		return false
+	}
+	return true
+}
+
+// AuditLog Append-only log of the mutating actions in the data folder
+// Entries are never rewritten, one JSON entry per line
+type AuditLog struct {
+	Mutex sync.Mutex
+}
+
+// Audit Global audit log
+var Audit = &AuditLog{}
+
+// path Return the path of the audit log file
+func (a *AuditLog) path() string {
+	return filepath.Join(GetDataFolder(), auditFile)
+}
+
+// Add Append the entry to the audit log
+func (a *AuditLog) Add(entry AuditEntry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	if entry.Actor == "" {
+		entry.Actor = AuditActorAuto
+	}
+	if entry.Kind == "" && entry.Name != "" {
+		entry.Kind = KindPlugin
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Logger.Errorln("Error encoding audit entry:", err)
+		return
+	}
+	a.Mutex.Lock()
+	defer a.Mutex.Unlock()
+	err = os.MkdirAll(GetDataFolder(), 0755)
+	if err == nil {
+		var file *os.File
+		file, err = os.OpenFile(a.path(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err == nil {
+			_, err = file.Write(append(line, '\n'))
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	}
+	if err != nil {
+		log.Logger.Errorln("Error writing audit log:", err)
+	}
+}
+
+// Query Return the entries matching the filter, the oldest first
+// Broken lines are skipped
+func (a *AuditLog) Query(filter AuditFilter) ([]AuditEntry, error) {
+	a.Mutex.Lock()
+	defer a.Mutex.Unlock()
+	entries := []AuditEntry{}
+	file, err := os.Open(a.path())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entries, nil
+		}
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+			continue
+		}
+		if filter.Match(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// auditCsvHeader Columns of the CSV export
+var auditCsvHeader = []string{"time", "actor", "action", "host", "kind", "name", "old_sha256", "new_sha256", "version", "result", "error"}
+
+// WriteAuditCsv Write the entries as CSV with the header
+func WriteAuditCsv(w io.Writer, entries []AuditEntry) error {
+	writer := csv.NewWriter(w)
+	err := writer.Write(auditCsvHeader)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		err = writer.Write([]string{e.Time.Format(time.RFC3339), e.Actor, e.Action, e.Host, e.Kind, e.Name,
+			e.OldSha256, e.NewSha256, e.Version, e.Result, e.Error})
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// WriteAuditJsonLines Write the entries as JSON lines
+func WriteAuditJsonLines(w io.Writer, entries []AuditEntry) error {
+	encoder := json.NewEncoder(w)
+	for _, entry := range entries {
+		err := encoder.Encode(entry)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WithError Return the entry with the failed result and the error text or the ok result if there is no error
+func (e AuditEntry) WithError(err error) AuditEntry {
+	if err != nil {
+		e.Result = "failed"
+		e.Error = err.Error()
+	} else {
+		e.Result = "ok"
+	}
+	return e
+}
+
+// AgentInstallEntry Return the audit entry of the agent install on the node
+func AgentInstallEntry(actor, host string, result AgentInstallResult) AuditEntry {
+	entry := AuditEntry{
+		Actor:   actor,
+		Action:  AuditAgentInstall,
+		Host:    host,
+		Version: result.Version,
+		Result:  "ok",
+	}
+	if !result.Success {
+		entry.Result = "failed"
+		entry.Error = result.Error
+	}
+	return entry
+}
+
+// actorKey Key of the actor in the context
+type actorKey struct{}
+
+// WithActor Return the context with the actor of the action
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext Return the actor of the action, auto-remediation if not set
+func ActorFromContext(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorKey{}).(string); ok && actor != "" {
+		return actor
+	}
+	return AuditActorAuto
+}
+
+// AuditConfig Config seen on the last start for the config and pin change entries
+type AuditConfig struct {
+	Sha256 string            `json:"sha256"`
+	Pins   map[string]string `json:"pins"`
+}
+
+// ConfigPins Return the pinned sha256 of the plugins from the config by name
+func ConfigPins() map[string]string {
+	pins := make(map[string]string)
+	for _, plugin := range config.ConfigCmkGetter.Plugins {
+		if plugin.Sha256 != "" {
+			pins[plugin.Name] = plugin.Sha256
+		}
+	}
+	return pins
+}
+
+// DiffConfig Return the audit entries for the changes between the previous and the current config
+// Nothing is returned on the first start without the previous config
+func DiffConfig(previous, current AuditConfig) []AuditEntry {
+	if previous.Sha256 == "" || previous.Sha256 == current.Sha256 {
+		return nil
+	}
+	entries := []AuditEntry{{
+		Action:    AuditConfigChange,
+		OldSha256: previous.Sha256,
+		NewSha256: current.Sha256,
+		Result:    "ok",
+	}}
+	names := make([]string, 0, len(previous.Pins)+len(current.Pins))
+	for name := range previous.Pins {
+		names = append(names, name)
+	}
+	for name := range current.Pins {
+		if _, ok := previous.Pins[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if previous.Pins[name] == current.Pins[name] {
+			continue
+		}
+		entries = append(entries, AuditEntry{
+			Action:    AuditPinChange,
+			Kind:      KindPlugin,
+			Name:      name,
+			OldSha256: previous.Pins[name],
+			NewSha256: current.Pins[name],
+			Result:    "ok",
+		})
+	}
+	return entries
+}
+
+// AuditConfigChanges Save the config and pin changes since the last start to the audit log
+// The config is read only on start, so the changes are found by the hash of config.yaml
+func AuditConfigChanges() {
+	content, err := os.ReadFile("config.yaml")
+	if err != nil {
+		log.Logger.Errorln("Error reading config for the audit:", err)
+		return
+	}
+	current := AuditConfig{Sha256: Sha256Hex(content), Pins: ConfigPins()}
+	var previous AuditConfig
+	err = LoadState(auditConfigState, &previous)
+	if err != nil {
+		log.Logger.Errorln("Error loading audit config state:", err)
+	}
+	for _, entry := range DiffConfig(previous, current) {
+		Audit.Add(entry)
+	}
+	err = SaveState(auditConfigState, current)
+	if err != nil {
+		log.Logger.Errorln("Error saving audit config state:", err)
+	}
+}
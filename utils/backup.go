@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"cmk_getter/config"
+	"cmk_getter/log"
+	"fmt"
+	"github.com/pkg/sftp"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// backupSuffix Suffix of the plugin backup on the node
+const backupSuffix = ".bak"
+
+// GetBackupPath Return local path of the plugin backup for the node
+// Backups are saved to <data folder>/backups/<host>/<kind>/<name>
+func GetBackupPath(host string, c CheckMkPlugin) string {
+	kind := c.Kind
+	if kind == "" {
+		kind = KindPlugin
+	}
+	return filepath.Join(GetDataFolder(), "backups", filepath.Base(host), kind, filepath.Base(c.Name))
+}
+
+// SavePluginBackup Save the replaced plugin content to the local backup
+func SavePluginBackup(host string, c CheckMkPlugin, content []byte) error {
+	backupPath := GetBackupPath(host, c)
+	err := os.MkdirAll(filepath.Dir(backupPath), 0755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(backupPath, content, 0644)
+}
+
+// LoadPluginBackup Read the local backup of the plugin for the node
+func LoadPluginBackup(host string, c CheckMkPlugin) ([]byte, error) {
+	return os.ReadFile(GetBackupPath(host, c))
+}
+
+// RemovePluginBackup Remove the local backup of the plugin for the node
+func RemovePluginBackup(host string, c CheckMkPlugin) error {
+	err := os.Remove(GetBackupPath(host, c))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// isBackupOf Check if the file name is the backup of the managed plugin
+func (node CheckMkNode) isBackupOf(kind, name string) bool {
+	return strings.HasSuffix(name, backupSuffix) && node.hasArtifact(kind, strings.TrimSuffix(name, backupSuffix))
+}
+
+// backupPlugin Save the replaced plugin content locally and as <name>.bak on the node if enabled
+// The backup on the node is not executable, so the agent does not run it
+func (node CheckMkNode) backupPlugin(sftpClient *sftp.Client, c CheckMkPlugin, content []byte) error {
+	err := SavePluginBackup(node.Host, c, content)
+	if err != nil {
+		return err
+	}
+	if !config.ConfigCmkGetter.RemotePluginBackup {
+		return nil
+	}
+	backupFile, err := sftpClient.Create(node.GetPluginPath(c) + backupSuffix)
+	if err != nil {
+		return err
+	}
+	err = backupFile.Chmod(0644)
+	if err == nil {
+		_, err = backupFile.Write(content)
+	}
+	closeErr := backupFile.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// RollbackPlugin Write the previous content of the plugin from the backup to the node
+func (node CheckMkNode) RollbackPlugin(c CheckMkPlugin) error {
+	return node.withSftp(func(sftpClient *sftp.Client) error {
+		return node.RestorePluginBackup(sftpClient, c)
+	})
+}
+
+// RestorePluginBackup Write the previous content of the plugin from the backup to the node
+func (node CheckMkNode) RestorePluginBackup(sftpClient *sftp.Client, c CheckMkPlugin) error {
+	content, err := LoadPluginBackup(node.Host, c)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("no backup of %s for %s", c.Name, node.Host)
+		}
+		return err
+	}
+	err = writePluginFile(sftpClient, node.GetPluginPath(c), content)
+	if err != nil {
+		return err
+	}
+	log.WithPlugin(node.Host, c.Name).Infoln("Plugin", c.Name, "rolled back on", node.Host)
+	return nil
+}
+
+// RevertPlugin Undo the send of the plugin on the node, see RevertPluginFile
+func (node CheckMkNode) RevertPlugin(c CheckMkPlugin, sent PluginSendResult) (bool, error) {
+	if sent.Action != PluginReplaced && sent.Action != PluginCreated {
+		return false, nil
+	}
+	reverted := false
+	err := node.withSftp(func(sftpClient *sftp.Client) error {
+		var err error
+		reverted, err = node.RevertPluginFile(sftpClient, c, sent)
+		return err
+	})
+	return reverted, err
+}
+
+// RevertPluginFile Undo the send of the plugin on the node
+// The replaced plugin is restored from the backup, the created plugin is removed and the unchanged plugin is kept,
+// so the rollback never writes a backup of an earlier deploy
+// Return true if the file on the node was changed back
+func (node CheckMkNode) RevertPluginFile(sftpClient *sftp.Client, c CheckMkPlugin, sent PluginSendResult) (bool, error) {
+	switch sent.Action {
+	case PluginReplaced:
+		err := node.RestorePluginBackup(sftpClient, c)
+		return err == nil, err
+	case PluginCreated:
+		err := sftpClient.Remove(node.GetPluginPath(c))
+		if err != nil {
+			return false, err
+		}
+		log.WithPlugin(node.Host, c.Name).Infoln("Plugin", c.Name, "created by the deploy removed from", node.Host)
+		return true, nil
+	default:
+		return false, nil
+	}
+}
@@ -0,0 +1,221 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Statuses of the bulk deploy items
+const (
+	BulkPending   = "pending"
+	BulkDeployed  = "deployed"
+	BulkFailing   = "failing"
+	BulkFailed    = "failed"
+	BulkCancelled = "cancelled"
+)
+
+// defaultBulkConcurrency Number of nodes deployed at the same time if not set in the request
+const defaultBulkConcurrency = 5
+
+// maxBulkConcurrency Max number of nodes deployed at the same time
+const maxBulkConcurrency = 50
+
+// BulkDeployRequest Nodes selectors and plugins for the bulk deploy
+// All set selectors must match the node, at least one selector is required
+type BulkDeployRequest struct {
+	// Explicit list of the hosts
+	Nodes []string `json:"nodes"`
+	// Label of the host as key:value, or only key to match any value
+	Label string `json:"label"`
+	// Check_MK folder of the host, subfolders are matched too
+	Folder string `json:"folder"`
+	// Only plugins which are not deployed on the node
+	Drifted bool `json:"drifted"`
+	// Plugin names, all configured plugins of the kind if empty
+	Plugins []string `json:"plugins"`
+	Kind    string   `json:"kind"`
+	// Number of nodes deployed at the same time
+	Concurrency int `json:"concurrency"`
+}
+
+// BulkDeployItem Result of the plugin deploy on the node
+type BulkDeployItem struct {
+	Status       string              `json:"status"`
+	Error        string              `json:"error,omitempty"`
+	Verification *PluginVerification `json:"verification,omitempty"`
+}
+
+// BulkDeployResult Results by host and plugin name
+type BulkDeployResult struct {
+	Results   map[string]map[string]BulkDeployItem `json:"results"`
+	Deployed  int                                  `json:"deployed"`
+	Failing   int                                  `json:"failing"`
+	Failed    int                                  `json:"failed"`
+	Cancelled int                                  `json:"cancelled"`
+}
+
+// matchLabel Check if the node has the label key:value or the key if no value is set
+func matchLabel(labels map[string]string, label string) bool {
+	key, value, hasValue := strings.Cut(label, ":")
+	nodeValue, ok := labels[key]
+	return ok && (!hasValue || nodeValue == value)
+}
+
+// matchFolder Check if the node is in the folder or its subfolders
+func matchFolder(nodeFolder, folder string) bool {
+	folder = strings.TrimSuffix(folder, "/")
+	return folder == "" || nodeFolder == folder || strings.HasPrefix(nodeFolder, folder+"/")
+}
+
+// PlanBulkDeploy Return the plugin names to deploy by host
+// Only available nodes matching all selectors are planned
+func PlanBulkDeploy(nodes []CheckMkNode, req BulkDeployRequest) (map[string][]string, error) {
+	if len(req.Nodes) == 0 && req.Label == "" && req.Folder == "" && !req.Drifted {
+		return nil, errors.New("no node selector")
+	}
+	hosts := make(map[string]bool)
+	for _, host := range req.Nodes {
+		hosts[host] = true
+	}
+	plan := make(map[string][]string)
+	for _, node := range nodes {
+		if !node.IsAvailable ||
+			(len(req.Nodes) > 0 && !hosts[node.Host]) ||
+			(req.Label != "" && !matchLabel(node.Labels, req.Label)) ||
+			(req.Folder != "" && !matchFolder(node.Folder, req.Folder)) {
+			continue
+		}
+		var names []string
+		for _, c := range node.GetArtifacts(req.Kind) {
+			if len(req.Plugins) > 0 && !containsString(req.Plugins, c.Name) {
+				continue
+			}
+			if req.Drifted && c.Status == PluginDeployed {
+				continue
+			}
+			names = append(names, c.Name)
+		}
+		if len(names) > 0 {
+			sort.Strings(names)
+			plan[node.Host] = names
+		}
+	}
+	if len(plan) == 0 {
+		return nil, errors.New("no plugins to deploy on the selected nodes")
+	}
+	return plan, nil
+}
+
+// containsString Check if the slice contains the string
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// GetBulkConcurrency Return the number of nodes deployed at the same time
+func (req BulkDeployRequest) GetBulkConcurrency() int {
+	switch {
+	case req.Concurrency <= 0:
+		return defaultBulkConcurrency
+	case req.Concurrency > maxBulkConcurrency:
+		return maxBulkConcurrency
+	default:
+		return req.Concurrency
+	}
+}
+
+// BulkDeployJob Create the job function deploying the planned plugins
+// Plugins of one node are deployed one by one, the nodes are deployed with bounded concurrency
+func BulkDeployJob(plan map[string][]string, kind string, concurrency int) JobFunc {
+	return func(ctx context.Context, step StepLogger) (interface{}, error) {
+		result := BulkDeployResult{Results: make(map[string]map[string]BulkDeployItem)}
+		var mutex sync.Mutex
+		setItem := func(host, name string, item BulkDeployItem) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			result.Results[host][name] = item
+		}
+		for host, names := range plan {
+			result.Results[host] = make(map[string]BulkDeployItem)
+			for _, name := range names {
+				result.Results[host][name] = BulkDeployItem{Status: BulkPending}
+			}
+		}
+
+		semaphore := make(chan struct{}, concurrency)
+		var wg sync.WaitGroup
+		for host, names := range plan {
+			wg.Add(1)
+			go func(host string, names []string) {
+				defer wg.Done()
+				semaphore <- struct{}{}
+				defer func() {
+					<-semaphore
+				}()
+				hostStep := func(format string, args ...interface{}) {
+					step("%s: %s", host, fmt.Sprintf(format, args...))
+				}
+				for _, name := range names {
+					setItem(host, name, deployBulkItem(ctx, host, kind, name, hostStep))
+				}
+			}(host, names)
+		}
+		wg.Wait()
+		TriggerPluginChecker()
+
+		for _, items := range result.Results {
+			for _, item := range items {
+				switch item.Status {
+				case BulkDeployed:
+					result.Deployed++
+				case BulkFailing:
+					result.Failing++
+				case BulkCancelled:
+					result.Cancelled++
+				default:
+					result.Failed++
+				}
+			}
+		}
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		if result.Failed > 0 || result.Failing > 0 {
+			return result, fmt.Errorf("%d failed and %d failing of %d deploys",
+				result.Failed, result.Failing, result.Failed+result.Failing+result.Deployed)
+		}
+		return result, nil
+	}
+}
+
+// deployBulkItem Deploy one plugin of the bulk deploy to the node
+func deployBulkItem(ctx context.Context, host, kind, name string, step StepLogger) BulkDeployItem {
+	if ctx.Err() != nil {
+		return BulkDeployItem{Status: BulkCancelled}
+	}
+	node, ok := CheckMkNodeMap.GetAvailableNode(host)
+	if !ok {
+		step("Node is not available")
+		return BulkDeployItem{Status: BulkFailed, Error: "node is not available"}
+	}
+	verification, err := node.DeployPlugin(ctx, node.FindArtifact(kind, name), step)
+	switch {
+	case errors.Is(err, context.Canceled):
+		return BulkDeployItem{Status: BulkCancelled}
+	case err != nil:
+		step("Error deploying %s: %s", name, err)
+		return BulkDeployItem{Status: BulkFailed, Error: err.Error()}
+	case !verification.Success:
+		return BulkDeployItem{Status: BulkFailing, Error: verification.Error, Verification: &verification}
+	default:
+		return BulkDeployItem{Status: BulkDeployed, Verification: &verification}
+	}
+}
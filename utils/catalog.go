@@ -0,0 +1,190 @@
+package utils
+
+import (
+	"cmk_getter/log"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// catalogState Name of the state file with the plugin catalog
+const catalogState = "catalog"
+
+// catalogHrefRegexp Links in the directory listing of the Check_MK server
+var catalogHrefRegexp = regexp.MustCompile(`(?i)<a\s+[^>]*href="([^"]+)"`)
+
+// pluginVersionRegexp Version variable in the plugin source
+var pluginVersionRegexp = regexp.MustCompile(`(?m)^\s*(?:__version__|CMK_VERSION|VERSION)\s*=\s*["']([^"']+)["']`)
+
+// CatalogPlugin Plugin available on the Check_MK server
+type CatalogPlugin struct {
+	Name    string `json:"name"`
+	Size    int    `json:"size"`
+	Sha256  string `json:"sha256"`
+	Md5     string `json:"md5"`
+	Version string `json:"version,omitempty"`
+}
+
+// CatalogNodeState State of the catalog plugin on the node
+type CatalogNodeState struct {
+	Host       string `json:"host"`
+	Status     string `json:"status"`
+	NodeSha256 string `json:"node_sha256,omitempty"`
+}
+
+// CatalogPluginNodes Catalog plugin with the nodes where it is configured
+type CatalogPluginNodes struct {
+	CatalogPlugin
+	Nodes    []CatalogNodeState `json:"nodes"`
+	Deployed int                `json:"deployed"`
+	Drifted  int                `json:"drifted"`
+	Failing  int                `json:"failing"`
+}
+
+// PluginCatalog Plugins found on the Check_MK server
+type PluginCatalog struct {
+	Plugins   map[string]CatalogPlugin `json:"plugins"`
+	UpdatedAt time.Time                `json:"updated_at"`
+	Error     string                   `json:"error,omitempty"`
+	Mutex     sync.Mutex               `json:"-"`
+}
+
+// Catalog Global catalog of the plugins on the Check_MK server
+var Catalog = &PluginCatalog{
+	Plugins: make(map[string]CatalogPlugin),
+}
+
+// ParsePluginListing Return plugin names from the directory listing of agents/plugins
+// Sorting links, parent and sub folders are skipped
+func ParsePluginListing(listing string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, match := range catalogHrefRegexp.FindAllStringSubmatch(listing, -1) {
+		href := match[1]
+		if strings.HasPrefix(href, "?") || strings.HasPrefix(href, "/") || strings.HasSuffix(href, "/") ||
+			strings.Contains(href, "://") || strings.HasPrefix(href, "#") {
+			continue
+		}
+		name, err := url.PathUnescape(href)
+		if err != nil || name == "" || strings.Contains(name, "/") || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParsePluginVersion Return version from __version__ or CMK_VERSION in the plugin source
+func ParsePluginVersion(content []byte) string {
+	match := pluginVersionRegexp.FindSubmatch(content)
+	if match == nil {
+		return ""
+	}
+	return string(match[1])
+}
+
+// RefreshCatalog Read the plugin listing from the Check_MK server and get the plugins from the cache
+func RefreshCatalog() error {
+	_, listing, err := GetUrl("json", CheckMkPlugin{}.CreateUrl())
+	if err != nil {
+		Catalog.setError(err)
+		return err
+	}
+	plugins := make(map[string]CatalogPlugin)
+	for _, name := range ParsePluginListing(string(listing)) {
+		cached, err := PluginSources.Get(CheckMkPlugin{Name: name}.CreateUrl())
+		if err != nil {
+			log.Logger.Debugln("Error getting plugin", name, "for the catalog:", err)
+			continue
+		}
+		plugins[name] = CatalogPlugin{
+			Name:    name,
+			Size:    cached.Size,
+			Sha256:  cached.Sha256,
+			Md5:     cached.Md5,
+			Version: ParsePluginVersion(cached.Content),
+		}
+	}
+	Catalog.Mutex.Lock()
+	defer Catalog.Mutex.Unlock()
+	Catalog.Plugins = plugins
+	Catalog.UpdatedAt = time.Now()
+	Catalog.Error = ""
+	err = SaveState(catalogState, Catalog)
+	if err != nil {
+		log.Logger.Errorln("Error saving plugin catalog:", err)
+	}
+	log.Logger.Infoln("Plugin catalog updated with", len(plugins), "plugins")
+	return nil
+}
+
+// setError Save the error of the last refresh
+func (p *PluginCatalog) setError(err error) {
+	p.Mutex.Lock()
+	defer p.Mutex.Unlock()
+	p.Error = err.Error()
+}
+
+// List Return the catalog plugins with the states on the nodes sorted by name
+func (p *PluginCatalog) List() []CatalogPluginNodes {
+	p.Mutex.Lock()
+	list := []CatalogPluginNodes{}
+	for _, plugin := range p.Plugins {
+		list = append(list, CatalogPluginNodes{CatalogPlugin: plugin, Nodes: []CatalogNodeState{}})
+	}
+	p.Mutex.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+
+	CheckMkNodeMap.Mutex.Lock()
+	defer CheckMkNodeMap.Mutex.Unlock()
+	for i := range list {
+		for _, node := range CheckMkNodeMap.Nodes {
+			for _, plugin := range node.Plugins {
+				if plugin.Name != list[i].Name {
+					continue
+				}
+				list[i].Nodes = append(list[i].Nodes, CatalogNodeState{
+					Host:       node.Host,
+					Status:     plugin.Status,
+					NodeSha256: plugin.NodeSha256,
+				})
+				switch plugin.Status {
+				case PluginDeployed:
+					list[i].Deployed++
+				case PluginFailing:
+					list[i].Failing++
+				default:
+					list[i].Drifted++
+				}
+			}
+		}
+		sort.Slice(list[i].Nodes, func(a, b int) bool {
+			return list[i].Nodes[a].Host < list[i].Nodes[b].Host
+		})
+	}
+	return list
+}
+
+// CatalogTicker Load the catalog from the state file and refresh it every hour
+func CatalogTicker() {
+	Catalog.Mutex.Lock()
+	err := LoadState(catalogState, Catalog)
+	Catalog.Mutex.Unlock()
+	if err != nil {
+		log.Logger.Errorln("Error loading plugin catalog:", err)
+	}
+	for {
+		err := RefreshCatalog()
+		if err != nil {
+			log.Logger.Infoln("Error refreshing plugin catalog:", err)
+		}
+		time.Sleep(time.Hour)
+	}
+}
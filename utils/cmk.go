@@ -10,23 +10,26 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 )
 
-func init() {
-	// Get the current version of check_mk
+// InitCurrentVersion Get the current version of check_mk from the API
+// Called on start of the server, not in init, so the local-check subcommand works without Check_MK
+func InitCurrentVersion() error {
 	cmkVersionUrl := fmt.Sprintf(urlTemplate, config.ConfigCmkGetter.Domain, config.ConfigCmkGetter.Site, cmkVersionUrl)
 	_, response, err := GetUrl("json", cmkVersionUrl)
 	if err != nil {
-		log.Logger.Fatalln(err)
+		return err
 	}
 	cmkVersion, err := GetCmkVersion(response)
 	if err != nil {
-		log.Logger.Fatalln(err)
+		return err
 	}
 	CurrentVersion = cmkVersion.CroppedVersion()
+	return nil
 }
 
 // CheckMkNodeMap Global struct CmkNodeMap for get and update nodes with mutex
@@ -34,6 +37,89 @@ var CheckMkNodeMap = &CmkNodeMap{
 	Nodes: make(map[string]CheckMkNode),
 }
 
+// GetAvailableNode Return the node by host if ssh is available on the node
+func (m *CmkNodeMap) GetAvailableNode(host string) (CheckMkNode, bool) {
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+	node, ok := m.Nodes[host]
+	if !ok || !node.IsAvailable {
+		return CheckMkNode{}, false
+	}
+	return node, true
+}
+
+// List Return copies of all nodes sorted by host
+func (m *CmkNodeMap) List() []CheckMkNode {
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+	nodes := make([]CheckMkNode, 0, len(m.Nodes))
+	for _, node := range m.Nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Host < nodes[j].Host
+	})
+	return nodes
+}
+
+// UpdateNode Change the node in the map with the update function under the lock
+func (m *CmkNodeMap) UpdateNode(host string, update func(node *CheckMkNode)) {
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+	node, ok := m.Nodes[host]
+	if !ok {
+		return
+	}
+	update(&node)
+	m.Nodes[host] = node
+}
+
+// UpdateNodePlugin Change the plugin or local check of the node with the update function under the lock
+func (m *CmkNodeMap) UpdateNodePlugin(host string, c CheckMkPlugin, update func(plugin *CheckMkPlugin)) {
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+	node, ok := m.Nodes[host]
+	if !ok {
+		return
+	}
+	// Copy the list to not change the nodes returned before
+	plugins := append([]CheckMkPlugin(nil), node.GetArtifacts(c.Kind)...)
+	for i := range plugins {
+		if plugins[i].Name == c.Name {
+			update(&plugins[i])
+		}
+	}
+	publishPluginChanges(host, node.GetArtifacts(c.Kind), plugins)
+	if c.Kind == KindLocal {
+		node.LocalChecks = plugins
+	} else {
+		node.Plugins = plugins
+	}
+	m.Nodes[host] = node
+}
+
+// RemoveNodePlugin Remove the plugin or local check from the lists of the node
+func (m *CmkNodeMap) RemoveNodePlugin(host string, c CheckMkPlugin) {
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+	node, ok := m.Nodes[host]
+	if !ok {
+		return
+	}
+	plugins := []CheckMkPlugin{}
+	for _, plugin := range node.GetArtifacts(c.Kind) {
+		if plugin.Name != c.Name {
+			plugins = append(plugins, plugin)
+		}
+	}
+	if c.Kind == KindLocal {
+		node.LocalChecks = plugins
+	} else {
+		node.Plugins = plugins
+	}
+	m.Nodes[host] = node
+}
+
 func BearerToken() string {
 	// Generate Bearer Token from Username and Password with base64
 	username := config.ConfigCmkGetter.Username
@@ -43,15 +129,36 @@ func BearerToken() string {
 
 // GetUrl Get url from the API as []byte
 func GetUrl(getType, url string) (http.Header, []byte, error) {
+	statusCode, header, body, err := GetUrlWithHeaders(getType, url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Get status code
+	if statusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("status code error: %d %s", statusCode, http.StatusText(statusCode))
+	}
+	return header, body, nil
+}
+
+// GetUrlWithHeaders Get url from the API with the extra request headers
+// Return the status code, so the caller can handle responses like 304 Not Modified
+func GetUrlWithHeaders(getType, url string, extraHeader http.Header) (int, http.Header, []byte, error) {
 	// Create client
 	client := &http.Client{}
 	// Create request
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		return nil, nil, err
+		return 0, nil, nil, err
+	}
+	for key, values := range extraHeader {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	// Add Bearer Token to the request, the credentials are sent to the Check_MK server only
+	if IsCheckMkUrl(url) {
+		req.Header.Add("Authorization", BearerToken())
 	}
-	// Add Bearer Token to the request
-	req.Header.Add("Authorization", BearerToken())
 	// Set application/json to the request
 	switch getType {
 	case "json":
@@ -63,24 +170,23 @@ func GetUrl(getType, url string) (http.Header, []byte, error) {
 	req.Header.Add("User-Agent", "cmk_getter")
 
 	// Get response
+	start := time.Now()
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, nil, err
+		Metrics.ObserveHTTPRequest(url, time.Since(start), 0, err)
+		return 0, nil, nil, err
 	}
+	Metrics.ObserveHTTPRequest(url, time.Since(start), resp.StatusCode, nil)
 	defer func() {
 		_ = resp.Body.Close()
 	}()
-	// Get status code
-	if resp.StatusCode != http.StatusOK {
-		return nil, nil, fmt.Errorf("status code error: %d %s", resp.StatusCode, resp.Status)
-	}
 	// Read response body
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, nil, err
+		return 0, nil, nil, err
 	}
 
-	return resp.Header, body, nil
+	return resp.StatusCode, resp.Header, body, nil
 }
 
 // GetCmkVersion Get the current version of check_mk from the API
@@ -104,32 +210,39 @@ func (c *CmkVersionResponse) CroppedVersion() string {
 }
 
 // IsSameVersion Find the current version of check_mk from the API in files folder
-// And return bool if the version is the same
+// And return bool if the packages of all formats are downloaded
 func (c *CmkVersionResponse) IsSameVersion(folderPath string) (bool, error) {
 	// Create folder if not exists
 	err := os.MkdirAll(folderPath, 0755)
 	if err != nil {
 		return false, err
 	}
-
-	// Get the files names in the folder
-	files, err := GetFiles(folderPath)
-	if err != nil {
-		return false, err
-	}
-	// Find CmkVersionResponse.Version.Checkmk in the file names
-	for _, file := range files {
-		// Check if CmkVersionResponse.Version.Checkmk contains the file name
-		if strings.Contains(file, c.CroppedVersion()) {
-			return true, nil
+	for _, format := range AgentPackageFormats {
+		_, err = os.Stat(filepath.Join(folderPath, AgentPackageName(format, c.CroppedVersion())))
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
 		}
 	}
-	return false, nil
+	return true, nil
 }
 
+// CreateSymlink Link check-mk-agent-latest.<format> to the packages of the version
 func CreateSymlink(folderPath, currentVersion string) error {
+	for _, format := range AgentPackageFormats {
+		err := createPackageSymlink(folderPath, format, currentVersion)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func createPackageSymlink(folderPath, format, currentVersion string) error {
 	// Create symlink
-	oldFilename := "check-mk-agent_" + currentVersion + "-1_all.deb"
+	oldFilename := AgentPackageName(format, currentVersion)
 	// Get absolute path of the file
 	oldPath := folderPath + "/" + oldFilename
 	// Convert to oldPath to absolute path
@@ -137,7 +250,7 @@ func CreateSymlink(folderPath, currentVersion string) error {
 	if err != nil {
 		return err
 	}
-	newPath := folderPath + "/check-mk-agent-latest.deb"
+	newPath := folderPath + "/" + LatestAgentPackageName(format)
 	// Check if symlink exists and link to the same file
 	if _, err := os.Lstat(newPath); err == nil {
 		// Check if the symlink is the same
@@ -169,6 +282,7 @@ func CmkVersionChecker(ticker *time.Ticker, channel chan CmkVersionChanges) {
 	for {
 		select {
 		case <-ticker.C:
+			Health.Start(SubsystemVersionChecker)
 			// Create version url
 			versionUrl := fmt.Sprintf(urlTemplate, cmkDomain, cmkSite, cmkVersionUrl)
 			// Get the version from the API
@@ -189,7 +303,10 @@ func CmkVersionChecker(ticker *time.Ticker, channel chan CmkVersionChanges) {
 					ErrorString:     "Response from check_mk API is not valid",
 					TriggerDownload: false,
 				}
+			} else {
+				Metrics.SetLastVersionCheck(time.Now())
 			}
+			Health.Finish(SubsystemVersionChecker, err)
 
 			// Check if the version is the same in all folders
 			for _, folder := range config.ConfigCmkGetter.Folders {
@@ -227,15 +344,30 @@ func CmkVersionChecker(ticker *time.Ticker, channel chan CmkVersionChanges) {
 	}
 }
 
-// DownloadCmk Download the check_mk version from the API
+// DownloadCmk Download the agent packages of the check_mk version from the API
+// Packages already in the folder are not downloaded again
 func (c *CmkVersionChanges) DownloadCmk(folderPath string) error {
 	// Create folder if not exists
 	err := os.MkdirAll(folderPath, 0755)
 	if err != nil {
 		return err
 	}
+	for _, format := range AgentPackageFormats {
+		if _, err := os.Stat(filepath.Join(folderPath, AgentPackageName(format, c.Version))); err == nil {
+			continue
+		}
+		err = downloadAgentPackage(folderPath, format)
+		if err != nil {
+			return fmt.Errorf("%s package: %w", format, err)
+		}
+	}
+	return nil
+}
+
+// downloadAgentPackage Download the agent package of the format to the folder
+func downloadAgentPackage(folderPath, format string) error {
 	// Create the url
-	downloadUrl := fmt.Sprintf(urlTemplate, cmkDomain, cmkSite, downloadUrlTemplate)
+	downloadUrl := fmt.Sprintf(urlTemplate, cmkDomain, cmkSite, fmt.Sprintf(downloadUrlTemplate, format))
 	// Get the file from the API
 	respHeader, file, err := GetUrl("file", downloadUrl)
 	if err != nil {
@@ -274,14 +406,23 @@ func CmkVersionHandler(channel chan CmkVersionChanges) {
 		case versionChanges := <-channel:
 			if versionChanges.TriggerDownload {
 				// Log the version changes
-				log.Logger.Infoln("New version of check_mk: %s", versionChanges.Version)
+				log.WithVersion(versionChanges.Version).Infof("New version of check_mk: %s", versionChanges.Version)
 				// Download the new version
 				err := versionChanges.DownloadCmk(versionChanges.Folder)
+				Audit.Add(AuditEntry{
+					Action:  AuditAgentDownload,
+					Version: versionChanges.Version,
+				}.WithError(err))
 				if err != nil {
-					log.Logger.Infoln(err)
+					log.WithVersion(versionChanges.Version).Errorf("Error downloading version %s: %s", versionChanges.Version, err)
+				} else {
+					// Log the download
+					log.WithVersion(versionChanges.Version).Infof("Downloaded version: %s in folder %s", versionChanges.Version, versionChanges.Folder)
+					Events.Publish(EventAgentVersion, AgentVersionEvent{
+						Version: versionChanges.Version,
+						Folder:  versionChanges.Folder,
+					})
 				}
-				// Log the download
-				log.Logger.Infoln("Downloaded version: %s in folder %s", versionChanges.Version, versionChanges.Folder)
 			}
 			if versionChanges.ErrorString != "" {
 				log.Logger.Infoln(versionChanges.ErrorString)
@@ -294,8 +435,23 @@ func CmkVersionHandler(channel chan CmkVersionChanges) {
 func GenerateDefaultPlugins(c *CheckMkNode) {
 	for _, plugin := range config.ConfigCmkGetter.Plugins {
 		c.Plugins = append(c.Plugins, CheckMkPlugin{
-			Name:     plugin,
+			Name:         plugin.Name,
+			IsActual:     false,
+			Interval:     plugin.Interval,
+			Section:      plugin.Section,
+			Source:       plugin.Source,
+			Url:          plugin.Url,
+			PinnedSha256: plugin.Sha256,
+			Status:       PluginDrifted,
+		})
+	}
+	for _, localCheck := range config.ConfigCmkGetter.LocalChecks {
+		c.LocalChecks = append(c.LocalChecks, CheckMkPlugin{
+			Name:     localCheck.Name,
 			IsActual: false,
+			Interval: localCheck.Interval,
+			Kind:     KindLocal,
+			Status:   PluginDrifted,
 		})
 	}
 }
@@ -316,21 +472,30 @@ func GetNodesList() error {
 	if err != nil {
 		return err
 	}
+	CheckMkNodeMap.Mutex.Lock()
+	defer CheckMkNodeMap.Mutex.Unlock()
 	// Iterate over the nodes
 	for _, node := range cmkNodeResp.Value {
 		// Check if the node has the tag_check_mk-agent-conn = ssh
 
 		if node.Extensions.Attributes.TagCheckMkAgentConn == "ssh" {
+			// Folder and labels can be changed in the Check_MK config
+			if cmkNode, ok := CheckMkNodeMap.Nodes[node.Id]; ok {
+				cmkNode.Folder = node.Extensions.Folder
+				cmkNode.Labels = node.Extensions.Attributes.Labels
+				CheckMkNodeMap.Nodes[node.Id] = cmkNode
+				continue
+			}
 			// Create a new CheckMkNode
 			cmkNode := CheckMkNode{
-				Host: node.Id,
+				Host:   node.Id,
+				Folder: node.Extensions.Folder,
+				Labels: node.Extensions.Attributes.Labels,
 			}
 			// Generate the default plugins list
 			GenerateDefaultPlugins(&cmkNode)
-			// Add the node to the map if node is not in the map
-			if _, ok := CheckMkNodeMap.Nodes[node.Id]; !ok {
-				CheckMkNodeMap.Nodes[node.Id] = cmkNode
-			}
+			// Add the node to the map
+			CheckMkNodeMap.Nodes[node.Id] = cmkNode
 		}
 	}
 	return nil
@@ -339,7 +504,9 @@ func GetNodesList() error {
 // Ticker Get the nodes list every 5 minutes
 func GetNodesTicker() {
 	for {
+		Health.Start(SubsystemNodeRefresher)
 		err := GetNodesList()
+		Health.Finish(SubsystemNodeRefresher, err)
 		if err != nil {
 			log.Logger.Infoln(err)
 		}
@@ -347,13 +514,27 @@ func GetNodesTicker() {
 	}
 }
 
+// SSHStatusChecked Closed after the first check of ssh status on all nodes
+var SSHStatusChecked = make(chan struct{})
+
+var sshStatusCheckedOnce sync.Once
+
 func SSHStatusUpdater() {
 	for {
+		Health.Start(SubsystemSSHUpdater)
+		firstCheck := true
+		select {
+		case <-SSHStatusChecked:
+			firstCheck = false
+		default:
+		}
+		// Copy the nodes under the lock, the map is changed by the other goroutines
+		nodes := CheckMkNodeMap.List()
 		// Check if the map is not empty
-		if len(CheckMkNodeMap.Nodes) > 0 {
+		if len(nodes) > 0 {
 			// Create waitgroup for the goroutines
 			var wg sync.WaitGroup
-			for _, node := range CheckMkNodeMap.Nodes {
+			for _, node := range nodes {
 				// Add 1 to the waitgroup
 				wg.Add(1)
 				// Start the goroutine
@@ -363,19 +544,25 @@ func SSHStatusUpdater() {
 					// Get ssh status
 					sshStatus := node.CheckSsh()
 					if sshStatus != node.IsAvailable {
-						// Lock the map
-						CheckMkNodeMap.Mutex.Lock()
-						defer CheckMkNodeMap.Mutex.Unlock()
-						// Update the node
-						node.IsAvailable = sshStatus
-						CheckMkNodeMap.Nodes[node.Host] = node
+						// Update only the availability, the plugins may be changed by PluginChecker
+						CheckMkNodeMap.UpdateNode(node.Host, func(node *CheckMkNode) {
+							node.IsAvailable = sshStatus
+						})
+						Events.Publish(EventNode, NodeEvent{Host: node.Host, IsAvailable: sshStatus, FirstCheck: firstCheck})
 					}
 				}(node)
 			}
 			// Wait for the goroutines to finish and send true to the channel PluginCheckerTrigger and sleep 20 seconds
 			wg.Wait()
-			PluginCheckerTrigger <- true
+			sshStatusCheckedOnce.Do(func() {
+				close(SSHStatusChecked)
+			})
+			TriggerPluginChecker()
+			Health.Finish(SubsystemSSHUpdater, nil)
 			time.Sleep(20 * time.Second)
+		} else {
+			// No nodes to check, the updater is still alive
+			Health.Finish(SubsystemSSHUpdater, nil)
 		}
 		// Sleep 2 seconds
 		time.Sleep(2 * time.Second)
@@ -0,0 +1,209 @@
+package utils
+
+import (
+	"bytes"
+	"cmk_getter/config"
+	"cmk_getter/log"
+	"fmt"
+	"html/template"
+	"net/smtp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// digestPeriod Period of the events in the digest
+const digestPeriod = 24 * time.Hour
+
+// DigestDrift Plugins currently not deployed on the node
+type DigestDrift struct {
+	Host    string   `json:"host"`
+	Drifted []string `json:"drifted"`
+	Failing []string `json:"failing"`
+}
+
+// Digest Summary of the last day from the history and the node store
+type Digest struct {
+	From           time.Time      `json:"from"`
+	To             time.Time      `json:"to"`
+	CurrentVersion string         `json:"current_version"`
+	Nodes          int            `json:"nodes"`
+	AvailableNodes int            `json:"available_nodes"`
+	AgentVersions  []HistoryEntry `json:"agent_versions"`
+	Unreachable    []HistoryEntry `json:"unreachable"`
+	Drifted        []HistoryEntry `json:"drifted"`
+	Deploys        []HistoryEntry `json:"deploys"`
+	DeploysOk      int            `json:"deploys_ok"`
+	DeploysFailed  int            `json:"deploys_failed"`
+	// Nodes with drifted or failing plugins at the time of the digest
+	CurrentDrift []DigestDrift `json:"current_drift"`
+}
+
+// BuildDigest Create the digest of the history entries from the time to-digestPeriod to the time to
+func BuildDigest(to time.Time, entries []HistoryEntry, nodes []CheckMkNode) Digest {
+	digest := Digest{
+		From:           to.Add(-digestPeriod),
+		To:             to,
+		CurrentVersion: CurrentVersion,
+		Nodes:          len(nodes),
+	}
+	for _, entry := range entries {
+		if !entry.Time.After(digest.From) || entry.Time.After(to) {
+			continue
+		}
+		switch entry.Event {
+		case NotifyAgentVersion:
+			digest.AgentVersions = append(digest.AgentVersions, entry)
+		case NotifyNodeUnreachable:
+			digest.Unreachable = append(digest.Unreachable, entry)
+		case NotifyPluginDrifted:
+			digest.Drifted = append(digest.Drifted, entry)
+		case HistoryDeploy:
+			digest.Deploys = append(digest.Deploys, entry)
+			if entry.Result == PluginDeployed {
+				digest.DeploysOk++
+			} else {
+				digest.DeploysFailed++
+			}
+		}
+	}
+	for _, node := range nodes {
+		if node.IsAvailable {
+			digest.AvailableNodes++
+		}
+		drifted, failing := countPlugins(node)
+		if len(drifted) > 0 || len(failing) > 0 {
+			digest.CurrentDrift = append(digest.CurrentDrift, DigestDrift{Host: node.Host, Drifted: drifted, Failing: failing})
+		}
+	}
+	sort.Slice(digest.CurrentDrift, func(i, j int) bool {
+		return digest.CurrentDrift[i].Host < digest.CurrentDrift[j].Host
+	})
+	return digest
+}
+
+// digestTemplate HTML of the digest email
+var digestTemplate = template.Must(template.New("digest").Funcs(template.FuncMap{
+	"time": func(t time.Time) string {
+		return t.Format("2006-01-02 15:04")
+	},
+	"join": strings.Join,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>cmk_getter digest</title></head>
+<body style="font-family: sans-serif">
+<h2>cmk_getter digest {{time .From}} &ndash; {{time .To}}</h2>
+<p>Agent version: <b>{{.CurrentVersion}}</b>. Nodes available by SSH: <b>{{.AvailableNodes}} of {{.Nodes}}</b>.</p>
+
+<h3>New agent versions</h3>
+{{if .AgentVersions}}<ul>{{range .AgentVersions}}<li>{{time .Time}} {{.Version}}</li>{{end}}</ul>{{else}}<p>None</p>{{end}}
+
+<h3>Nodes went unreachable</h3>
+{{if .Unreachable}}<ul>{{range .Unreachable}}<li>{{time .Time}} {{.Host}}</li>{{end}}</ul>{{else}}<p>None</p>{{end}}
+
+<h3>Plugins drifted</h3>
+{{if .Drifted}}<ul>{{range .Drifted}}<li>{{time .Time}} {{.Host}}: {{.Kind}} {{.Name}}</li>{{end}}</ul>{{else}}<p>None</p>{{end}}
+
+<h3>Deploys: {{.DeploysOk}} succeeded, {{.DeploysFailed}} failed</h3>
+{{if .Deploys}}<table border="1" cellpadding="4" cellspacing="0">
+<tr><th>Time</th><th>Node</th><th>Plugin</th><th>Result</th><th>Error</th></tr>
+{{range .Deploys}}<tr><td>{{time .Time}}</td><td>{{.Host}}</td><td>{{.Kind}} {{.Name}}</td><td>{{.Result}}</td><td>{{.Error}}</td></tr>
+{{end}}</table>{{else}}<p>None</p>{{end}}
+
+<h3>Current drift</h3>
+{{if .CurrentDrift}}<table border="1" cellpadding="4" cellspacing="0">
+<tr><th>Node</th><th>Drifted</th><th>Failing</th></tr>
+{{range .CurrentDrift}}<tr><td>{{.Host}}</td><td>{{join .Drifted ", "}}</td><td>{{join .Failing ", "}}</td></tr>
+{{end}}</table>{{else}}<p>All plugins are deployed</p>{{end}}
+</body>
+</html>
+`))
+
+// RenderDigest Return the digest as HTML
+func RenderDigest(digest Digest) (string, error) {
+	var html bytes.Buffer
+	err := digestTemplate.Execute(&html, digest)
+	if err != nil {
+		return "", err
+	}
+	return html.String(), nil
+}
+
+// CurrentDigest Return the digest of the last day
+func CurrentDigest() Digest {
+	now := time.Now()
+	return BuildDigest(now, History.Since(now.Add(-digestPeriod)), CheckMkNodeMap.List())
+}
+
+// IsSmtpConfigured Check if the SMTP server and the recipients are set
+func IsSmtpConfigured() bool {
+	return config.ConfigCmkGetter.Smtp.Host != "" && len(config.ConfigCmkGetter.Smtp.To) > 0
+}
+
+// SendDigest Send the digest of the last day by SMTP
+func SendDigest() error {
+	if !IsSmtpConfigured() {
+		return fmt.Errorf("smtp is not configured")
+	}
+	digest := CurrentDigest()
+	html, err := RenderDigest(digest)
+	if err != nil {
+		return err
+	}
+	cfg := config.ConfigCmkGetter.Smtp
+	port := cfg.Port
+	if port == 0 {
+		port = 25
+	}
+	from := cfg.From
+	if from == "" {
+		from = "cmk_getter@localhost"
+	}
+	subject := fmt.Sprintf("cmk_getter digest: %d deploys, %d failed, %d nodes with drift",
+		len(digest.Deploys), digest.DeploysFailed, len(digest.CurrentDrift))
+	message := "From: " + from + "\r\n" +
+		"To: " + strings.Join(cfg.To, ", ") + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/html; charset=UTF-8\r\n" +
+		"\r\n" + html
+	var auth smtp.Auth
+	if cfg.Username != "" {
+		auth = smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)
+	}
+	// STARTTLS is used if the server supports it
+	return smtp.SendMail(fmt.Sprintf("%s:%d", cfg.Host, port), auth, from, cfg.To, []byte(message))
+}
+
+// NextDigestTime Return the next time of the digest at the hour after now
+func NextDigestTime(now time.Time, hour int) time.Time {
+	next := time.Date(now.Year(), now.Month(), now.Day(), hour, 0, 0, 0, now.Location())
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// DigestTicker Send the digest every day at the configured hour if SMTP is configured
+func DigestTicker() {
+	if !IsSmtpConfigured() {
+		return
+	}
+	hour := config.ConfigCmkGetter.Smtp.DigestHour
+	if hour < 0 || hour > 23 {
+		log.Logger.Errorln("Invalid digest hour", hour, "the digest is disabled")
+		return
+	}
+	for {
+		next := NextDigestTime(time.Now(), hour)
+		log.Logger.Debugln("Next digest at", next)
+		time.Sleep(time.Until(next))
+		err := SendDigest()
+		if err != nil {
+			log.Logger.Errorln("Error sending digest:", err)
+			continue
+		}
+		log.Logger.Infoln("Digest sent to", strings.Join(config.ConfigCmkGetter.Smtp.To, ", "))
+	}
+}
@@ -0,0 +1,155 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+// Types of the events
+const (
+	// EventNode Availability of the node is changed
+	EventNode = "node"
+	// EventPlugin Status of the plugin or local check on the node is changed
+	EventPlugin = "plugin"
+	// EventAgentVersion New agent version is downloaded from the Check_MK server
+	EventAgentVersion = "agent-version"
+	// EventJob Job is queued, got the new step or finished
+	EventJob = "job"
+)
+
+// eventBuffer Number of events buffered for the slow subscriber, the next events are dropped
+const eventBuffer = 100
+
+// reliableEventBuffer Number of events buffered for the reliable subscriber, the publisher waits when it is full
+const reliableEventBuffer = 1000
+
+// Event Change in the backend streamed to the UI
+type Event struct {
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+// NodeEvent Availability of the node
+type NodeEvent struct {
+	Host        string `json:"host"`
+	IsAvailable bool   `json:"is_available"`
+	// Availability is found by the first check after the start
+	FirstCheck bool `json:"first_check"`
+}
+
+// PluginEvent Status of the plugin or local check on the node
+type PluginEvent struct {
+	Host           string `json:"host"`
+	Kind           string `json:"kind"`
+	Name           string `json:"name"`
+	Status         string `json:"status"`
+	PreviousStatus string `json:"previous_status"`
+}
+
+// AgentVersionEvent Downloaded agent version
+type AgentVersionEvent struct {
+	Version string `json:"version"`
+	Folder  string `json:"folder"`
+}
+
+// JobEvent Status of the job with the new step
+type JobEvent struct {
+	Id     string   `json:"id"`
+	Type   string   `json:"type"`
+	Status string   `json:"status"`
+	Step   *JobStep `json:"step,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// EventBus Subscribers of the events
+type EventBus struct {
+	// subscribers UI streams, events are dropped when they are slow
+	subscribers map[chan Event]bool
+	// reliable Notifications and history, every event is delivered
+	reliable map[chan Event]bool
+	Mutex    sync.Mutex
+}
+
+// Events Global bus of the events
+var Events = NewEventBus()
+
+// NewEventBus Return the bus without subscribers
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subscribers: make(map[chan Event]bool),
+		reliable:    make(map[chan Event]bool),
+	}
+}
+
+// Subscribe Return the channel receiving the events
+func (b *EventBus) Subscribe() chan Event {
+	b.Mutex.Lock()
+	defer b.Mutex.Unlock()
+	ch := make(chan Event, eventBuffer)
+	b.subscribers[ch] = true
+	return ch
+}
+
+// SubscribeReliable Return the channel receiving every event
+// The publisher waits when the channel is full, so the subscriber must read it until the end and never block on the bus
+func (b *EventBus) SubscribeReliable() chan Event {
+	b.Mutex.Lock()
+	defer b.Mutex.Unlock()
+	ch := make(chan Event, reliableEventBuffer)
+	b.reliable[ch] = true
+	return ch
+}
+
+// Unsubscribe Stop sending the events to the channel
+func (b *EventBus) Unsubscribe(ch chan Event) {
+	b.Mutex.Lock()
+	defer b.Mutex.Unlock()
+	delete(b.subscribers, ch)
+	delete(b.reliable, ch)
+}
+
+// Publish Send the event to the reliable subscribers and to the other subscribers without waiting for them
+func (b *EventBus) Publish(eventType string, data interface{}) {
+	event := Event{Type: eventType, Time: time.Now(), Data: data}
+	b.Mutex.Lock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+	reliable := make([]chan Event, 0, len(b.reliable))
+	for ch := range b.reliable {
+		reliable = append(reliable, ch)
+	}
+	b.Mutex.Unlock()
+	// Slow reliable subscriber does not block the subscriptions of the UI streams
+	for _, ch := range reliable {
+		ch <- event
+	}
+}
+
+// publishPluginChanges Publish the events for the plugins with the changed status
+func publishPluginChanges(host string, previous, current []CheckMkPlugin) {
+	statuses := make(map[string]string)
+	for _, plugin := range previous {
+		statuses[plugin.Name] = plugin.Status
+	}
+	for _, plugin := range current {
+		if statuses[plugin.Name] == plugin.Status {
+			continue
+		}
+		kind := plugin.Kind
+		if kind == "" {
+			kind = KindPlugin
+		}
+		Events.Publish(EventPlugin, PluginEvent{
+			Host:           host,
+			Kind:           kind,
+			Name:           plugin.Name,
+			Status:         plugin.Status,
+			PreviousStatus: statuses[plugin.Name],
+		})
+	}
+}
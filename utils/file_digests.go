@@ -0,0 +1,197 @@
+package utils
+
+import (
+	"cmk_getter/config"
+	"cmk_getter/log"
+	"github.com/fsnotify/fsnotify"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// digestsState Name of the state file with the file digests
+const digestsState = "digests"
+
+// digestDelay Delay of hashing after the last write to the file
+const digestDelay = 2 * time.Second
+
+// digestsSaveInterval Interval of saving the changed cache to the state file
+const digestsSaveInterval = time.Minute
+
+// FileDigest Hashes of the file with the size and modification time they were calculated for
+type FileDigest struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Md5     string    `json:"md5"`
+	Sha256  string    `json:"sha256"`
+}
+
+// DigestCache Cache of the file hashes by path with mutex
+type DigestCache struct {
+	Digests map[string]FileDigest
+	Mutex   sync.Mutex
+	// dirty is set when the digests are changed since the last save
+	dirty bool
+	// saveMutex keeps the order of the saved snapshots
+	saveMutex sync.Mutex
+}
+
+// FileDigests Global cache of the hashes of files in the configured folders
+var FileDigests = &DigestCache{
+	Digests: make(map[string]FileDigest),
+}
+
+// Get Return md5 and sha256 of the file from the cache
+// The file is hashed again if its size or modification time changed
+// The cache is written to the state file by Save
+func (d *DigestCache) Get(path string) (string, string, error) {
+	path = filepath.Clean(path)
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", "", err
+	}
+	d.Mutex.Lock()
+	digest, ok := d.Digests[path]
+	d.Mutex.Unlock()
+	if ok && digest.Size == info.Size() && digest.ModTime.Equal(info.ModTime()) {
+		return digest.Md5, digest.Sha256, nil
+	}
+	md5, sha256, err := GetFileHashes(path)
+	if err != nil {
+		return "", "", err
+	}
+	d.Mutex.Lock()
+	d.Digests[path] = FileDigest{
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Md5:     md5,
+		Sha256:  sha256,
+	}
+	d.dirty = true
+	d.Mutex.Unlock()
+	return md5, sha256, nil
+}
+
+// Invalidate Remove the file from the cache
+func (d *DigestCache) Invalidate(path string) {
+	path = filepath.Clean(path)
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	if _, ok := d.Digests[path]; ok {
+		delete(d.Digests, path)
+		d.dirty = true
+	}
+}
+
+// Save Write the cache to the state file if it is changed since the last save
+// The digests are copied, so the lookups are not blocked while the file is written
+func (d *DigestCache) Save() error {
+	d.saveMutex.Lock()
+	defer d.saveMutex.Unlock()
+	d.Mutex.Lock()
+	if !d.dirty {
+		d.Mutex.Unlock()
+		return nil
+	}
+	digests := make(map[string]FileDigest, len(d.Digests))
+	for path, digest := range d.Digests {
+		digests[path] = digest
+	}
+	d.dirty = false
+	d.Mutex.Unlock()
+	err := SaveState(digestsState, digests)
+	if err != nil {
+		d.Mutex.Lock()
+		d.dirty = true
+		d.Mutex.Unlock()
+	}
+	return err
+}
+
+// LoadDigests Load the cache from the state file
+func LoadDigests() {
+	FileDigests.Mutex.Lock()
+	defer FileDigests.Mutex.Unlock()
+	err := LoadState(digestsState, &FileDigests.Digests)
+	if err != nil {
+		log.Logger.Errorln("Error loading file digests:", err)
+	}
+	if FileDigests.Digests == nil {
+		FileDigests.Digests = make(map[string]FileDigest)
+	}
+}
+
+// WatchFolders Invalidate the digests of changed files in the configured folders
+// New and changed files are hashed in the background, so the listing does not wait for them
+func WatchFolders() {
+	LoadDigests()
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Logger.Errorln("Error creating folders watcher:", err)
+		return
+	}
+	defer func() {
+		_ = watcher.Close()
+	}()
+	for _, folder := range config.ConfigCmkGetter.Folders {
+		// Folder is created by the version checker if not exists
+		err = os.MkdirAll(folder, 0755)
+		if err == nil {
+			err = watcher.Add(folder)
+		}
+		if err != nil {
+			log.Logger.Errorln("Error watching folder", folder+":", err)
+		}
+	}
+	log.Logger.Infoln("Start folders watcher")
+	// Pending hashing by path, the entry is removed when the file is hashed
+	timers := make(map[string]*time.Timer)
+	var timersMutex sync.Mutex
+	saveTicker := time.NewTicker(digestsSaveInterval)
+	defer saveTicker.Stop()
+	for {
+		select {
+		case <-saveTicker.C:
+			err := FileDigests.Save()
+			if err != nil {
+				log.Logger.Errorln("Error saving file digests:", err)
+			}
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			path := event.Name
+			FileDigests.Invalidate(path)
+			if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Write) {
+				continue
+			}
+			// Hash the file when writes are finished
+			timersMutex.Lock()
+			if timer, ok := timers[path]; ok && timer.Stop() {
+				timer.Reset(digestDelay)
+				timersMutex.Unlock()
+				continue
+			}
+			var timer *time.Timer
+			timer = time.AfterFunc(digestDelay, func() {
+				timersMutex.Lock()
+				// The timer may be replaced by a new one after it fired
+				if timers[path] == timer {
+					delete(timers, path)
+				}
+				timersMutex.Unlock()
+				if _, _, err := FileDigests.Get(path); err != nil {
+					log.Logger.Debugln("Error hashing file", path+":", err)
+				}
+			})
+			timers[path] = timer
+			timersMutex.Unlock()
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Logger.Errorln("Folders watcher error:", err)
+		}
+	}
+}
@@ -2,11 +2,24 @@ package utils
 
 import (
 	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 )
 
+// CmkFile File of the folder in the /api/cmk-files listing
+type CmkFile struct {
+	Name   string `json:"name"`
+	MD5    string `json:"md5"`
+	SHA256 string `json:"sha256"`
+	Date   string `json:"date"`
+	Size   int64  `json:"size"`
+}
+
 func GetFiles(path string) ([]string, error) {
 	// Get files from path
 	files, err := os.ReadDir(path)
@@ -48,6 +61,24 @@ func GetMD5(path string) (string, error) {
 	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
+// GetFileHashes Calculate md5 and sha256 hashes of the file with one read
+func GetFileHashes(path string) (string, string, error) {
+	// Open file
+	file, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	md5Hash := md5.New()
+	sha256Hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(md5Hash, sha256Hash), file); err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(md5Hash.Sum(nil)), hex.EncodeToString(sha256Hash.Sum(nil)), nil
+}
+
 func GetDate(path string) string {
 	// Get file info
 	file, err := os.Stat(path)
@@ -56,3 +87,47 @@ func GetDate(path string) string {
 	}
 	return file.ModTime().Format("2006-01-02 15:04:05")
 }
+
+// GetFolderFiles Return the files of the folder with the cached hashes
+func GetFolderFiles(folder string) ([]CmkFile, error) {
+	files, err := GetFiles(folder)
+	if err != nil {
+		return nil, err
+	}
+	folderFiles := []CmkFile{}
+	for _, file := range files {
+		path := filepath.Join(folder, file)
+		md5, sha256, err := FileDigests.Get(path)
+		if err != nil {
+			return nil, err
+		}
+		size, err := GetFileSize(path)
+		if err != nil {
+			return nil, err
+		}
+		folderFiles = append(folderFiles, CmkFile{
+			Name:   file,
+			MD5:    md5,
+			SHA256: sha256,
+			Date:   GetDate(path),
+			Size:   size,
+		})
+	}
+	return folderFiles, nil
+}
+
+// ChecksumHeaders Return the X-Checksum and Digest headers of the file download
+func ChecksumHeaders(path string) (map[string]string, error) {
+	md5, sha256, err := FileDigests.Get(path)
+	if err != nil {
+		return nil, err
+	}
+	md5Bytes, _ := hex.DecodeString(md5)
+	sha256Bytes, _ := hex.DecodeString(sha256)
+	return map[string]string{
+		"X-Checksum-Md5":    md5,
+		"X-Checksum-Sha256": sha256,
+		"Digest": fmt.Sprintf("SHA-256=%s,MD5=%s",
+			base64.StdEncoding.EncodeToString(sha256Bytes), base64.StdEncoding.EncodeToString(md5Bytes)),
+	}, nil
+}
@@ -0,0 +1,266 @@
+package utils
+
+import (
+	"cmk_getter/config"
+	"cmk_getter/log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Names of the subsystems reporting the runs
+const (
+	SubsystemVersionChecker = "version-checker"
+	SubsystemNodeRefresher  = "node-refresher"
+	SubsystemSSHUpdater     = "ssh-updater"
+	SubsystemPluginChecker  = "plugin-checker"
+)
+
+// stalledIntervals Subsystem is stalled if it has not finished a run for this number of intervals
+const stalledIntervals = 3
+
+// SubsystemState Last run and last error of the background goroutine
+type SubsystemState struct {
+	Name          string        `json:"name"`
+	Interval      time.Duration `json:"-"`
+	IntervalSec   float64       `json:"interval_seconds"`
+	Running       bool          `json:"running"`
+	Runs          int           `json:"runs"`
+	LastStart     *time.Time    `json:"last_start,omitempty"`
+	LastFinish    *time.Time    `json:"last_finish,omitempty"`
+	LastError     string        `json:"last_error,omitempty"`
+	LastErrorTime *time.Time    `json:"last_error_time,omitempty"`
+	// Last run was finished with the error
+	Failing bool `json:"failing"`
+	Stalled bool `json:"stalled"`
+}
+
+// HealthRegistry States of the subsystems
+type HealthRegistry struct {
+	subsystems map[string]*SubsystemState
+	started    time.Time
+	Mutex      sync.Mutex
+}
+
+// NewHealthRegistry Create the registry, the subsystems are stalled relative to the start time
+func NewHealthRegistry(started time.Time) *HealthRegistry {
+	return &HealthRegistry{
+		subsystems: make(map[string]*SubsystemState),
+		started:    started,
+	}
+}
+
+// Health Global registry of the subsystem states
+var Health = NewHealthRegistry(time.Now())
+
+// Register Add the subsystem with the expected interval between the runs
+func (h *HealthRegistry) Register(name string, interval time.Duration) {
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+	h.subsystems[name] = &SubsystemState{Name: name, Interval: interval, IntervalSec: interval.Seconds()}
+}
+
+// state Return the state of the subsystem, unknown subsystems are registered without interval
+func (h *HealthRegistry) state(name string) *SubsystemState {
+	state, ok := h.subsystems[name]
+	if !ok {
+		state = &SubsystemState{Name: name}
+		h.subsystems[name] = state
+	}
+	return state
+}
+
+// Start Save the start of the subsystem run
+func (h *HealthRegistry) Start(name string) {
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+	now := time.Now()
+	state := h.state(name)
+	state.Running = true
+	state.LastStart = &now
+}
+
+// Finish Save the end of the subsystem run with the error
+func (h *HealthRegistry) Finish(name string, err error) {
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+	now := time.Now()
+	state := h.state(name)
+	state.Running = false
+	state.Runs++
+	state.LastFinish = &now
+	state.Failing = err != nil
+	if err != nil {
+		state.LastError = err.Error()
+		state.LastErrorTime = &now
+	}
+}
+
+// Subsystems Return the states of the subsystems sorted by name
+// The subsystem is stalled if no run was finished for stalledIntervals intervals
+func (h *HealthRegistry) Subsystems(now time.Time) []SubsystemState {
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+	list := []SubsystemState{}
+	for _, state := range h.subsystems {
+		s := *state
+		reference := h.started
+		if s.LastFinish != nil {
+			reference = *s.LastFinish
+		}
+		s.Stalled = s.Interval > 0 && now.Sub(reference) > stalledIntervals*s.Interval
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// FolderState Writability of the folder
+type FolderState struct {
+	Path     string `json:"path"`
+	Writable bool   `json:"writable"`
+	Error    string `json:"error,omitempty"`
+}
+
+// CheckFolderWritable Create and remove the temporary file in the folder
+func CheckFolderWritable(folder string) FolderState {
+	state := FolderState{Path: folder}
+	f, err := os.CreateTemp(folder, ".cmk_getter_health_*")
+	if err != nil {
+		state.Error = err.Error()
+		return state
+	}
+	_ = f.Close()
+	err = os.Remove(f.Name())
+	if err != nil {
+		state.Error = err.Error()
+		return state
+	}
+	state.Writable = true
+	return state
+}
+
+// HealthReport State of the subsystems, Check_MK server and folders
+type HealthReport struct {
+	Status     string           `json:"status"`
+	Subsystems []SubsystemState `json:"subsystems"`
+	// Check_MK API answered the last nodes request
+	CheckMkReachable bool          `json:"checkmk_reachable"`
+	CheckMkError     string        `json:"checkmk_error,omitempty"`
+	Folders          []FolderState `json:"folders"`
+	// SSH status of all nodes was checked at least once
+	SSHChecked bool     `json:"ssh_checked"`
+	Problems   []string `json:"problems"`
+}
+
+// IsOk Check if the report has no problems
+func (r HealthReport) IsOk() bool {
+	return len(r.Problems) == 0
+}
+
+// HealthCheck Return the report with stalled subsystems as problems
+func HealthCheck() HealthReport {
+	report := HealthReport{
+		Subsystems: Health.Subsystems(time.Now()),
+		Folders:    []FolderState{},
+		Problems:   []string{},
+	}
+	for _, state := range report.Subsystems {
+		if state.Stalled {
+			report.Problems = append(report.Problems, state.Name+" is stalled")
+		}
+		if state.Name == SubsystemNodeRefresher {
+			report.CheckMkReachable = state.Runs > 0 && !state.Failing
+			if state.Failing {
+				report.CheckMkError = state.LastError
+			}
+		}
+	}
+	select {
+	case <-SSHStatusChecked:
+		report.SSHChecked = true
+	default:
+	}
+	report.setStatus()
+	return report
+}
+
+// ReadyCheck Return the health report with the Check_MK reachability, folders writability
+// and the first SSH check as problems too
+func ReadyCheck() HealthReport {
+	report := HealthCheck()
+	if !report.CheckMkReachable {
+		report.Problems = append(report.Problems, "Check_MK API is not reachable")
+	}
+	if !report.SSHChecked {
+		report.Problems = append(report.Problems, "SSH status of the nodes is not checked yet")
+	}
+	for _, folder := range append(append([]string{}, config.ConfigCmkGetter.Folders...), GetDataFolder()) {
+		state := CheckFolderWritable(folder)
+		report.Folders = append(report.Folders, state)
+		if !state.Writable {
+			report.Problems = append(report.Problems, "folder "+folder+" is not writable: "+state.Error)
+		}
+	}
+	report.setStatus()
+	return report
+}
+
+// setStatus Set the status by the problems
+func (r *HealthReport) setStatus() {
+	r.Status = "ok"
+	if !r.IsOk() {
+		r.Status = "fail"
+	}
+}
+
+// sdNotify Send the state to the systemd notify socket
+func sdNotify(socket, state string) error {
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// SystemdNotify Notify systemd about the start and send the watchdog pings while the service is healthy
+// Works only with systemd_notify enabled and NOTIFY_SOCKET set by systemd
+func SystemdNotify() {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if !config.ConfigCmkGetter.SystemdNotify || socket == "" {
+		return
+	}
+	err := sdNotify(socket, "READY=1")
+	if err != nil {
+		log.Logger.Errorln("Error notifying systemd:", err)
+		return
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	// Ping twice per watchdog interval
+	interval := time.Duration(usec) * time.Microsecond / 2
+	log.Logger.Infoln("Send systemd watchdog pings every", interval)
+	for {
+		report := HealthCheck()
+		if report.IsOk() {
+			err = sdNotify(socket, "WATCHDOG=1")
+			if err != nil {
+				log.Logger.Errorln("Error sending systemd watchdog ping:", err)
+			}
+		} else {
+			log.Logger.Errorln("Skip systemd watchdog ping:", report.Problems)
+		}
+		time.Sleep(interval)
+	}
+}
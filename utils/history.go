@@ -0,0 +1,166 @@
+package utils
+
+import (
+	"cmk_getter/log"
+	"sync"
+	"time"
+)
+
+// historyState Name of the state file with the history
+const historyState = "history"
+
+// historyRetention Age of the history entries kept in the state file
+const historyRetention = 7 * 24 * time.Hour
+
+// historySaveInterval Interval of saving the changed history to the state file
+const historySaveInterval = time.Minute
+
+// HistoryDeploy Event of the deploy in the history, the other events are the notification events
+const HistoryDeploy = "deploy"
+
+// HistoryEntry Event saved to the history for the digest
+type HistoryEntry struct {
+	Time    time.Time `json:"time"`
+	Event   string    `json:"event"`
+	Host    string    `json:"host,omitempty"`
+	Kind    string    `json:"kind,omitempty"`
+	Name    string    `json:"name,omitempty"`
+	Version string    `json:"version,omitempty"`
+	// Result of the deploy: deployed, failing or failed
+	Result string `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// HistoryLog Entries of the last historyRetention
+type HistoryLog struct {
+	Entries []HistoryEntry
+	Mutex   sync.Mutex
+	// dirty is set when the entries are changed since the last save
+	dirty bool
+	// saveMutex keeps the order of the saved snapshots
+	saveMutex sync.Mutex
+}
+
+// History Global history of the agent versions, unreachable nodes, drift and deploys
+var History = &HistoryLog{
+	Entries: []HistoryEntry{},
+}
+
+// Add Add the entry to the history, the entries older than historyRetention are removed
+// The history is written to the state file by Save
+func (h *HistoryLog) Add(entry HistoryEntry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+	h.Entries = append(h.Entries, entry)
+	cutoff := time.Now().Add(-historyRetention)
+	for len(h.Entries) > 0 && h.Entries[0].Time.Before(cutoff) {
+		h.Entries = h.Entries[1:]
+	}
+	h.dirty = true
+}
+
+// Load Read the history from the state file
+func (h *HistoryLog) Load() error {
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+	return LoadState(historyState, &h.Entries)
+}
+
+// Save Write the history to the state file if it is changed since the last save
+// The entries are copied, so Add is not blocked while the file is written
+func (h *HistoryLog) Save() error {
+	h.saveMutex.Lock()
+	defer h.saveMutex.Unlock()
+	h.Mutex.Lock()
+	if !h.dirty {
+		h.Mutex.Unlock()
+		return nil
+	}
+	entries := make([]HistoryEntry, len(h.Entries))
+	copy(entries, h.Entries)
+	h.dirty = false
+	h.Mutex.Unlock()
+	err := SaveState(historyState, entries)
+	if err != nil {
+		h.Mutex.Lock()
+		h.dirty = true
+		h.Mutex.Unlock()
+	}
+	return err
+}
+
+// Since Return the entries after the time
+func (h *HistoryLog) Since(t time.Time) []HistoryEntry {
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+	list := []HistoryEntry{}
+	for _, entry := range h.Entries {
+		if entry.Time.After(t) {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// historyFromEvent Return the history entry for the new agent version, unreachable node or drifted plugin
+func historyFromEvent(event Event) (HistoryEntry, bool) {
+	notification, ok := NotificationFromEvent(event)
+	if !ok {
+		return HistoryEntry{}, false
+	}
+	entry := HistoryEntry{Time: event.Time, Event: notification.Event}
+	switch data := event.Data.(type) {
+	case AgentVersionEvent:
+		entry.Version = data.Version
+	case NodeEvent:
+		if data.IsAvailable {
+			return entry, false
+		}
+		entry.Host = data.Host
+	case PluginEvent:
+		if notification.Event != NotifyPluginDrifted {
+			return entry, false
+		}
+		entry.Host = data.Host
+		entry.Kind = data.Kind
+		entry.Name = data.Name
+	default:
+		// Deploys are saved by DeployPlugin
+		return entry, false
+	}
+	return entry, true
+}
+
+// LoadHistory Load the history from the state file
+// Must be called before the goroutines adding entries are started
+func LoadHistory() {
+	err := History.Load()
+	if err != nil {
+		log.Logger.Errorln("Error loading history:", err)
+	}
+}
+
+// HistorySaver Save the changed history to the state file every historySaveInterval
+func HistorySaver() {
+	ticker := time.NewTicker(historySaveInterval)
+	for range ticker.C {
+		err := History.Save()
+		if err != nil {
+			log.Logger.Errorln("Error saving history:", err)
+		}
+	}
+}
+
+// HistoryRecorder Save the events to the history
+func HistoryRecorder() {
+	events := Events.SubscribeReliable()
+	for event := range events {
+		entry, ok := historyFromEvent(event)
+		if ok {
+			History.Add(entry)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package utils
+
+import (
+	"cmk_getter/config"
+	"cmk_getter/log"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Job statuses
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// Types of the jobs
+const (
+	JobDeployPlugin = "deploy-plugin"
+	JobBulkDeploy   = "bulk-deploy"
+)
+
+// maxFinishedJobs Number of finished jobs kept in the queue
+const maxFinishedJobs = 1000
+
+// StepLogger Log the step of the long operation
+type StepLogger func(format string, args ...interface{})
+
+// JobStep Step of the job with the time
+type JobStep struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// JobFunc Function executed by the job worker
+type JobFunc func(ctx context.Context, step StepLogger) (interface{}, error)
+
+// Job Operation executed asynchronously by the job workers
+type Job struct {
+	Id         string      `json:"id"`
+	Type       string      `json:"type"`
+	Actor      string      `json:"actor"`
+	Status     string      `json:"status"`
+	Steps      []JobStep   `json:"steps"`
+	Error      string      `json:"error,omitempty"`
+	Result     interface{} `json:"result,omitempty"`
+	CreatedAt  time.Time   `json:"created_at"`
+	StartedAt  *time.Time  `json:"started_at,omitempty"`
+	FinishedAt *time.Time  `json:"finished_at,omitempty"`
+	run        JobFunc
+	ctx        context.Context
+	cancel     context.CancelFunc
+}
+
+// JobQueue Jobs by id with the queue for the workers
+type JobQueue struct {
+	Jobs   map[string]*Job
+	Mutex  sync.Mutex
+	queue  chan *Job
+	lastId int64
+}
+
+// ErrJobQueueFull Error of the submit when all queued jobs are waiting for the workers
+var ErrJobQueueFull = errors.New("job queue is full")
+
+// NewJobQueue Create the job queue with the number of jobs waiting for the workers
+func NewJobQueue(size int) *JobQueue {
+	return &JobQueue{
+		Jobs:  make(map[string]*Job),
+		queue: make(chan *Job, size),
+	}
+}
+
+// Jobs Global queue of the jobs
+var Jobs = NewJobQueue(10000)
+
+// Submit Add the job started by cmk_getter to the queue and return its copy
+func (q *JobQueue) Submit(jobType string, run JobFunc) (Job, error) {
+	return q.SubmitAs(AuditActorAuto, jobType, run)
+}
+
+// SubmitAs Add the job started by the actor to the queue and return its copy
+// The actor is passed to the job function in the context for the audit log
+// ErrJobQueueFull is returned without waiting if the queue is full
+func (q *JobQueue) SubmitAs(actor, jobType string, run JobFunc) (Job, error) {
+	ctx, cancel := context.WithCancel(WithActor(context.Background(), actor))
+	q.Mutex.Lock()
+	// Ids are unique even for jobs created at the same nanosecond
+	id := time.Now().UnixNano()
+	if id <= q.lastId {
+		id = q.lastId + 1
+	}
+	q.lastId = id
+	job := &Job{
+		Id:        fmt.Sprintf("%d", id),
+		Type:      jobType,
+		Actor:     actor,
+		Status:    JobQueued,
+		Steps:     []JobStep{},
+		CreatedAt: time.Now(),
+		run:       run,
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+	// Workers wait for the lock before they change the job, so the job is added to the map first
+	select {
+	case q.queue <- job:
+	default:
+		q.Mutex.Unlock()
+		cancel()
+		return Job{}, ErrJobQueueFull
+	}
+	q.Jobs[job.Id] = job
+	q.prune()
+	created := job.copy()
+	q.Mutex.Unlock()
+
+	log.WithJob(job.Id).Debugln("Job", job.Id, jobType, "queued")
+	Events.Publish(EventJob, JobEvent{Id: created.Id, Type: created.Type, Status: created.Status})
+	return created, nil
+}
+
+// prune Remove the oldest finished jobs over maxFinishedJobs, must be called under the lock
+func (q *JobQueue) prune() {
+	var finished []*Job
+	for _, job := range q.Jobs {
+		if job.FinishedAt != nil {
+			finished = append(finished, job)
+		}
+	}
+	if len(finished) <= maxFinishedJobs {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].FinishedAt.Before(*finished[j].FinishedAt)
+	})
+	for _, job := range finished[:len(finished)-maxFinishedJobs] {
+		delete(q.Jobs, job.Id)
+	}
+}
+
+// copy Return copy of the job, must be called under the lock
+func (j *Job) copy() Job {
+	c := *j
+	c.Steps = append([]JobStep{}, j.Steps...)
+	return c
+}
+
+// Get Return copy of the job by id
+func (q *JobQueue) Get(id string) (Job, bool) {
+	q.Mutex.Lock()
+	defer q.Mutex.Unlock()
+	job, ok := q.Jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return job.copy(), true
+}
+
+// List Return copies of all jobs sorted by creation time
+func (q *JobQueue) List() []Job {
+	q.Mutex.Lock()
+	defer q.Mutex.Unlock()
+	list := []Job{}
+	for _, job := range q.Jobs {
+		list = append(list, job.copy())
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Id < list[j].Id
+	})
+	return list
+}
+
+// Cancel Cancel the queued or running job
+// Running jobs are stopped before the next step
+func (q *JobQueue) Cancel(id string) error {
+	q.Mutex.Lock()
+	defer q.Mutex.Unlock()
+	job, ok := q.Jobs[id]
+	if !ok {
+		return fmt.Errorf("job %s not found", id)
+	}
+	if job.FinishedAt != nil {
+		return fmt.Errorf("job %s is %s", id, job.Status)
+	}
+	job.cancel()
+	return nil
+}
+
+// step Add the step to the job log
+func (q *JobQueue) step(job *Job, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	step := JobStep{Time: time.Now(), Message: message}
+	q.Mutex.Lock()
+	job.Steps = append(job.Steps, step)
+	event := JobEvent{Id: job.Id, Type: job.Type, Status: job.Status, Step: &step}
+	q.Mutex.Unlock()
+	log.WithJob(job.Id).Debugln("Job", job.Id+":", message)
+	Events.Publish(EventJob, event)
+}
+
+// finish Set the final status of the job
+func (q *JobQueue) finish(job *Job, result interface{}, err error) {
+	q.Mutex.Lock()
+	defer func() {
+		event := JobEvent{Id: job.Id, Type: job.Type, Status: job.Status, Error: job.Error}
+		q.Mutex.Unlock()
+		Events.Publish(EventJob, event)
+	}()
+	now := time.Now()
+	job.FinishedAt = &now
+	job.Result = result
+	// Job finished or failed by itself after the cancel request keeps its own result
+	switch {
+	case errors.Is(err, context.Canceled):
+		job.Status = JobCancelled
+		job.Error = "cancelled"
+	case err != nil:
+		job.Status = JobFailed
+		job.Error = err.Error()
+	default:
+		job.Status = JobSucceeded
+	}
+	job.cancel()
+}
+
+// execute Run the job in the worker
+func (q *JobQueue) execute(job *Job) {
+	q.Mutex.Lock()
+	if job.ctx.Err() != nil {
+		q.Mutex.Unlock()
+		q.finish(job, nil, job.ctx.Err())
+		return
+	}
+	now := time.Now()
+	job.StartedAt = &now
+	job.Status = JobRunning
+	q.Mutex.Unlock()
+	Events.Publish(EventJob, JobEvent{Id: job.Id, Type: job.Type, Status: JobRunning})
+
+	result, err := job.run(job.ctx, func(format string, args ...interface{}) {
+		q.step(job, format, args...)
+	})
+	if err != nil {
+		q.step(job, "Error: %s", err)
+	}
+	q.finish(job, result, err)
+}
+
+// GetJobWorkers Return number of the job workers
+func GetJobWorkers() int {
+	if config.ConfigCmkGetter.JobWorkers <= 0 {
+		return 4
+	}
+	return config.ConfigCmkGetter.JobWorkers
+}
+
+// JobWorkers Start the workers executing the queued jobs
+func JobWorkers() {
+	log.Logger.Infoln("Start", GetJobWorkers(), "job workers")
+	for i := 0; i < GetJobWorkers(); i++ {
+		go func() {
+			for job := range Jobs.queue {
+				Jobs.execute(job)
+			}
+		}()
+	}
+}
+
+// DeployPluginJob Create the job function deploying the plugin or local check to the node
+func DeployPluginJob(host, kind, name string) JobFunc {
+	return func(ctx context.Context, step StepLogger) (interface{}, error) {
+		node, ok := CheckMkNodeMap.GetAvailableNode(host)
+		if !ok {
+			return nil, fmt.Errorf("node %s not found", host)
+		}
+		verification, err := node.DeployPlugin(ctx, node.FindArtifact(kind, name), step)
+		if err != nil {
+			return nil, err
+		}
+		TriggerPluginChecker()
+		if !verification.Success {
+			return verification, fmt.Errorf("plugin deployed but failing: %s", verification.Error)
+		}
+		return verification, nil
+	}
+}
@@ -0,0 +1,246 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// httpDurationBuckets Upper bounds of the buckets of the HTTP request durations in seconds
+var httpDurationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// durationStats Count, failures and sum of the durations in seconds
+type durationStats struct {
+	Count    int
+	Failures int
+	Sum      float64
+}
+
+// httpStats Histogram of the HTTP request durations with counts by status code
+type httpStats struct {
+	Buckets []int
+	Count   int
+	Sum     float64
+	Codes   map[string]int
+}
+
+// MetricsRegistry Counters of the subsystems exposed in the Prometheus text format
+type MetricsRegistry struct {
+	// SSH dials by host
+	sshDials map[string]*durationStats
+	// HTTP requests by target: checkmk or external
+	httpRequests map[string]*httpStats
+	// Deploys by kind and result
+	deploys map[[2]string]int
+	// Time of the last successful version check on the Check_MK server
+	lastVersionCheck time.Time
+	Mutex            sync.Mutex
+}
+
+// Metrics Global registry of the metrics
+var Metrics = &MetricsRegistry{
+	sshDials:     make(map[string]*durationStats),
+	httpRequests: make(map[string]*httpStats),
+	deploys:      make(map[[2]string]int),
+}
+
+// ObserveSSHDial Save the duration and the result of the ssh dial to the node
+func (m *MetricsRegistry) ObserveSSHDial(host string, duration time.Duration, err error) {
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+	stats, ok := m.sshDials[host]
+	if !ok {
+		stats = &durationStats{}
+		m.sshDials[host] = stats
+	}
+	stats.Count++
+	stats.Sum += duration.Seconds()
+	if err != nil {
+		stats.Failures++
+	}
+}
+
+// ObserveHTTPRequest Save the duration and the status code of the request
+// The code is "error" if no response was received
+func (m *MetricsRegistry) ObserveHTTPRequest(url string, duration time.Duration, statusCode int, err error) {
+	target := "external"
+	if IsCheckMkUrl(url) {
+		target = "checkmk"
+	}
+	code := fmt.Sprintf("%d", statusCode)
+	if err != nil {
+		code = "error"
+	}
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+	stats, ok := m.httpRequests[target]
+	if !ok {
+		stats = &httpStats{Buckets: make([]int, len(httpDurationBuckets)), Codes: make(map[string]int)}
+		m.httpRequests[target] = stats
+	}
+	for i, bound := range httpDurationBuckets {
+		if duration.Seconds() <= bound {
+			stats.Buckets[i]++
+		}
+	}
+	stats.Count++
+	stats.Sum += duration.Seconds()
+	stats.Codes[code]++
+}
+
+// ObserveDeploy Count the deploy of the plugin or local check by the result
+func (m *MetricsRegistry) ObserveDeploy(kind, result string) {
+	if kind == "" {
+		kind = KindPlugin
+	}
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+	m.deploys[[2]string{kind, result}]++
+}
+
+// SetLastVersionCheck Save the time of the successful version check
+func (m *MetricsRegistry) SetLastVersionCheck(t time.Time) {
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+	m.lastVersionCheck = t
+}
+
+// LastVersionCheck Return the time of the last successful version check
+func (m *MetricsRegistry) LastVersionCheck() time.Time {
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+	return m.lastVersionCheck
+}
+
+// escapeLabel Escape the label value for the Prometheus text format
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// metricsWriter Write the metrics with HELP and TYPE lines once per metric
+type metricsWriter struct {
+	w   io.Writer
+	err error
+}
+
+// header Write the HELP and TYPE lines of the metric
+func (mw *metricsWriter) header(name, metricType, help string) {
+	mw.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// sample Write the sample with the labels as name, value pairs
+func (mw *metricsWriter) sample(name string, value float64, labels ...string) {
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], escapeLabel(labels[i+1])))
+	}
+	if len(pairs) > 0 {
+		name += "{" + strings.Join(pairs, ",") + "}"
+	}
+	mw.printf("%s %g\n", name, value)
+}
+
+// printf Write the formatted line, the writing is stopped after the first error
+func (mw *metricsWriter) printf(format string, args ...interface{}) {
+	if mw.err != nil {
+		return
+	}
+	_, mw.err = fmt.Fprintf(mw.w, format, args...)
+}
+
+// sortedKeys Return the sorted keys of the map
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// WriteMetrics Write the metrics of the nodes, plugins, SSH, HTTP requests and deploys
+// in the Prometheus text format
+func (m *MetricsRegistry) WriteMetrics(w io.Writer, nodes []CheckMkNode) error {
+	mw := &metricsWriter{w: w}
+
+	available := 0
+	plugins := make(map[string]int)
+	for _, node := range nodes {
+		if node.IsAvailable {
+			available++
+		}
+		for _, c := range append(append([]CheckMkPlugin{}, node.Plugins...), node.LocalChecks...) {
+			kind := c.Kind
+			if kind == "" {
+				kind = KindPlugin
+			}
+			plugins[kind+"\x00"+c.Name+"\x00"+c.Status]++
+		}
+	}
+	mw.header("cmk_getter_nodes", "gauge", "Number of the nodes with SSH agent connection.")
+	mw.sample("cmk_getter_nodes", float64(len(nodes)))
+	mw.header("cmk_getter_nodes_available", "gauge", "Number of the nodes available by SSH.")
+	mw.sample("cmk_getter_nodes_available", float64(available))
+	mw.header("cmk_getter_plugin_nodes", "gauge", "Number of the nodes by plugin and status.")
+	for _, key := range sortedKeys(plugins) {
+		parts := strings.SplitN(key, "\x00", 3)
+		mw.sample("cmk_getter_plugin_nodes", float64(plugins[key]), "kind", parts[0], "plugin", parts[1], "status", parts[2])
+	}
+
+	mw.header("cmk_getter_agent_version_info", "gauge", "Current agent version on the Check_MK server.")
+	mw.sample("cmk_getter_agent_version_info", 1, "version", CurrentVersion)
+
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+	mw.header("cmk_getter_last_version_check_timestamp_seconds", "gauge", "Time of the last successful version check.")
+	lastVersionCheck := 0.0
+	if !m.lastVersionCheck.IsZero() {
+		lastVersionCheck = float64(m.lastVersionCheck.Unix())
+	}
+	mw.sample("cmk_getter_last_version_check_timestamp_seconds", lastVersionCheck)
+
+	mw.header("cmk_getter_ssh_dial_duration_seconds", "summary", "Duration of the SSH dials by node.")
+	for _, host := range sortedKeys(m.sshDials) {
+		mw.sample("cmk_getter_ssh_dial_duration_seconds_sum", m.sshDials[host].Sum, "host", host)
+		mw.sample("cmk_getter_ssh_dial_duration_seconds_count", float64(m.sshDials[host].Count), "host", host)
+	}
+	mw.header("cmk_getter_ssh_dial_failures_total", "counter", "Number of the failed SSH dials by node.")
+	for _, host := range sortedKeys(m.sshDials) {
+		mw.sample("cmk_getter_ssh_dial_failures_total", float64(m.sshDials[host].Failures), "host", host)
+	}
+
+	mw.header("cmk_getter_http_request_duration_seconds", "histogram", "Duration of the HTTP requests by target.")
+	for _, target := range sortedKeys(m.httpRequests) {
+		stats := m.httpRequests[target]
+		for i, bound := range httpDurationBuckets {
+			mw.sample("cmk_getter_http_request_duration_seconds_bucket", float64(stats.Buckets[i]),
+				"target", target, "le", fmt.Sprintf("%g", bound))
+		}
+		mw.sample("cmk_getter_http_request_duration_seconds_bucket", float64(stats.Count), "target", target, "le", "+Inf")
+		mw.sample("cmk_getter_http_request_duration_seconds_sum", stats.Sum, "target", target)
+		mw.sample("cmk_getter_http_request_duration_seconds_count", float64(stats.Count), "target", target)
+	}
+	mw.header("cmk_getter_http_requests_total", "counter", "Number of the HTTP requests by target and status code.")
+	for _, target := range sortedKeys(m.httpRequests) {
+		codes := m.httpRequests[target].Codes
+		for _, code := range sortedKeys(codes) {
+			mw.sample("cmk_getter_http_requests_total", float64(codes[code]), "target", target, "code", code)
+		}
+	}
+
+	mw.header("cmk_getter_deploys_total", "counter", "Number of the deploys by kind and result.")
+	var deploys [][2]string
+	for key := range m.deploys {
+		deploys = append(deploys, key)
+	}
+	sort.Slice(deploys, func(i, j int) bool {
+		return deploys[i][0]+deploys[i][1] < deploys[j][0]+deploys[j][1]
+	})
+	for _, key := range deploys {
+		mw.sample("cmk_getter_deploys_total", float64(m.deploys[key]), "kind", key[0], "result", key[1])
+	}
+	return mw.err
+}
@@ -0,0 +1,271 @@
+package utils
+
+import (
+	"bytes"
+	"cmk_getter/config"
+	"cmk_getter/log"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Events of the notifications used in the webhook filters
+const (
+	NotifyAgentVersion    = "agent_version"
+	NotifyNodeUnreachable = "node_unreachable"
+	NotifyNodeAvailable   = "node_available"
+	NotifyPluginDrifted   = "plugin_drifted"
+	NotifyPluginFailing   = "plugin_failing"
+	NotifyDeployFailed    = "deploy_failed"
+	NotifyTest            = "test"
+)
+
+// Formats of the webhook payloads
+const (
+	WebhookJson       = "json"
+	WebhookSlack      = "slack"
+	WebhookMattermost = "mattermost"
+)
+
+// defaultWebhookRetries Number of retries if not set for the webhook
+const defaultWebhookRetries = 3
+
+// maxDeliveries Number of deliveries kept in the delivery log
+const maxDeliveries = 500
+
+// webhookTimeout Timeout of the webhook request
+const webhookTimeout = 10 * time.Second
+
+// Notification Event sent to the webhooks
+type Notification struct {
+	Event string      `json:"event"`
+	Time  time.Time   `json:"time"`
+	Title string      `json:"title"`
+	Text  string      `json:"text"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+// Delivery Result of the notification delivery to the webhook
+type Delivery struct {
+	Webhook    string    `json:"webhook"`
+	Event      string    `json:"event"`
+	Title      string    `json:"title"`
+	Time       time.Time `json:"time"`
+	Attempts   int       `json:"attempts"`
+	Success    bool      `json:"success"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// NotifierService Webhooks with the delivery log
+type NotifierService struct {
+	Webhooks []config.WebhookConfig
+	// Delay before the first retry, doubled for each next retry
+	RetryDelay time.Duration
+	deliveries []Delivery
+	Mutex      sync.Mutex
+}
+
+// NewNotifier Create the notifier for the webhooks
+func NewNotifier(webhooks []config.WebhookConfig) *NotifierService {
+	return &NotifierService{
+		Webhooks:   webhooks,
+		RetryDelay: 5 * time.Second,
+		deliveries: []Delivery{},
+	}
+}
+
+// Notifier Global notifier with the webhooks from the config
+var Notifier = NewNotifier(config.ConfigCmkGetter.Webhooks)
+
+// NotificationFromEvent Return the notification for the event
+// Only version changes, drift and failures are notified
+func NotificationFromEvent(event Event) (Notification, bool) {
+	n := Notification{Time: event.Time, Data: event.Data}
+	switch data := event.Data.(type) {
+	case AgentVersionEvent:
+		n.Event = NotifyAgentVersion
+		n.Title = "New agent version " + data.Version
+		n.Text = fmt.Sprintf("Agent %s downloaded to %s", data.Version, data.Folder)
+	case NodeEvent:
+		// Availability found on start is not a change
+		if data.FirstCheck {
+			return n, false
+		}
+		n.Event = NotifyNodeAvailable
+		n.Title = "Node " + data.Host + " is available"
+		n.Text = fmt.Sprintf("SSH on %s is available for cmk_getter again", data.Host)
+		if !data.IsAvailable {
+			n.Event = NotifyNodeUnreachable
+			n.Title = "Node " + data.Host + " is unreachable"
+			n.Text = fmt.Sprintf("SSH on %s is not available for cmk_getter", data.Host)
+		}
+	case PluginEvent:
+		switch {
+		case data.Status == PluginFailing:
+			n.Event = NotifyPluginFailing
+			n.Title = fmt.Sprintf("%s %s is failing on %s", data.Kind, data.Name, data.Host)
+			n.Text = fmt.Sprintf("Verification of %s %s failed on %s", data.Kind, data.Name, data.Host)
+		case data.Status == PluginDrifted && data.PreviousStatus == PluginDeployed:
+			n.Event = NotifyPluginDrifted
+			n.Title = fmt.Sprintf("%s %s drifted on %s", data.Kind, data.Name, data.Host)
+			n.Text = fmt.Sprintf("%s %s on %s is missing or different from the source", data.Kind, data.Name, data.Host)
+		default:
+			return n, false
+		}
+	case JobEvent:
+		if data.Status != JobFailed || (data.Type != JobDeployPlugin && data.Type != JobBulkDeploy) {
+			return n, false
+		}
+		n.Event = NotifyDeployFailed
+		n.Title = fmt.Sprintf("Job %s %s failed", data.Type, data.Id)
+		n.Text = data.Error
+	default:
+		return n, false
+	}
+	return n, true
+}
+
+// matchEvent Check if the webhook is subscribed to the event, all events if the filter is empty
+func matchEvent(webhook config.WebhookConfig, event string) bool {
+	if len(webhook.Events) == 0 || event == NotifyTest {
+		return true
+	}
+	return containsString(webhook.Events, event)
+}
+
+// WebhookPayload Return the body of the webhook request in the webhook format
+func WebhookPayload(format string, n Notification) ([]byte, error) {
+	switch format {
+	case "", WebhookJson:
+		return json.Marshal(n)
+	case WebhookSlack:
+		return json.Marshal(map[string]string{
+			"text": fmt.Sprintf("*%s*\n%s", n.Title, n.Text),
+		})
+	case WebhookMattermost:
+		return json.Marshal(map[string]string{
+			"username": "cmk_getter",
+			"text":     fmt.Sprintf("#### %s\n%s", n.Title, n.Text),
+		})
+	default:
+		return nil, fmt.Errorf("unknown webhook format %s", format)
+	}
+}
+
+// post Send the payload to the webhook url
+func post(url string, payload []byte) (int, error) {
+	client := &http.Client{Timeout: webhookTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("status code error: %d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+	return resp.StatusCode, nil
+}
+
+// webhookRetries Return the number of retries of the webhook, negative disables the retries
+func webhookRetries(webhook config.WebhookConfig) int {
+	switch {
+	case webhook.Retries < 0:
+		return 0
+	case webhook.Retries == 0:
+		return defaultWebhookRetries
+	default:
+		return webhook.Retries
+	}
+}
+
+// Deliver Send the notification to the webhook with retries and save the delivery to the log
+func (n *NotifierService) Deliver(webhook config.WebhookConfig, notification Notification) Delivery {
+	delivery := Delivery{
+		Webhook: webhook.Name,
+		Event:   notification.Event,
+		Title:   notification.Title,
+		Time:    time.Now(),
+	}
+	payload, err := WebhookPayload(webhook.Format, notification)
+	if err == nil {
+		delay := n.RetryDelay
+		for attempt := 0; attempt <= webhookRetries(webhook); attempt++ {
+			if attempt > 0 {
+				time.Sleep(delay)
+				delay *= 2
+			}
+			delivery.Attempts++
+			delivery.StatusCode, err = post(webhook.Url, payload)
+			if err == nil {
+				break
+			}
+			log.Logger.Debugln("Error sending notification to webhook", webhook.Name+":", err)
+		}
+	}
+	if err != nil {
+		delivery.Error = err.Error()
+		log.Logger.Errorln("Notification", notification.Event, "is not delivered to webhook", webhook.Name+":", err)
+	} else {
+		delivery.Success = true
+	}
+
+	n.Mutex.Lock()
+	defer n.Mutex.Unlock()
+	n.deliveries = append(n.deliveries, delivery)
+	if len(n.deliveries) > maxDeliveries {
+		n.deliveries = n.deliveries[len(n.deliveries)-maxDeliveries:]
+	}
+	return delivery
+}
+
+// Notify Send the notification to the subscribed webhooks and wait for the deliveries
+func (n *NotifierService) Notify(notification Notification) []Delivery {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	deliveries := []Delivery{}
+	for _, webhook := range n.Webhooks {
+		if !matchEvent(webhook, notification.Event) {
+			continue
+		}
+		wg.Add(1)
+		go func(webhook config.WebhookConfig) {
+			defer wg.Done()
+			delivery := n.Deliver(webhook, notification)
+			mutex.Lock()
+			defer mutex.Unlock()
+			deliveries = append(deliveries, delivery)
+		}(webhook)
+	}
+	wg.Wait()
+	return deliveries
+}
+
+// Deliveries Return the delivery log, the newest first
+func (n *NotifierService) Deliveries() []Delivery {
+	n.Mutex.Lock()
+	defer n.Mutex.Unlock()
+	list := make([]Delivery, 0, len(n.deliveries))
+	for i := len(n.deliveries) - 1; i >= 0; i-- {
+		list = append(list, n.deliveries[i])
+	}
+	return list
+}
+
+// Notifications Send the notifications for the events to the webhooks from the config
+func Notifications() {
+	if len(Notifier.Webhooks) == 0 {
+		return
+	}
+	log.Logger.Infoln("Send notifications to", len(Notifier.Webhooks), "webhooks")
+	events := Events.SubscribeReliable()
+	for event := range events {
+		notification, ok := NotificationFromEvent(event)
+		if !ok {
+			continue
+		}
+		go Notifier.Notify(notification)
+	}
+}
@@ -0,0 +1,112 @@
+package utils
+
+import (
+	"cmk_getter/log"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// CachedPlugin Plugin source downloaded from the Check_MK server with the validators of the response
+type CachedPlugin struct {
+	Url          string    `json:"url"`
+	Content      []byte    `json:"-"`
+	Size         int       `json:"size"`
+	Sha256       string    `json:"sha256"`
+	Md5          string    `json:"md5"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	FetchedAt    time.Time `json:"fetched_at"`
+	// Cycle of the plugin checker when the plugin was validated last time
+	cycle int
+	// mutex to not download the same plugin for many nodes at the same time
+	mutex sync.Mutex
+}
+
+// PluginCache Plugin sources by url shared between the nodes
+type PluginCache struct {
+	Plugins map[string]*CachedPlugin
+	// Cycle of the plugin checker, the plugins are revalidated once per cycle
+	Cycle int
+	Mutex sync.Mutex
+}
+
+// PluginSources Global cache of the plugin sources from the Check_MK server
+var PluginSources = &PluginCache{
+	Plugins: make(map[string]*CachedPlugin),
+	Cycle:   1,
+}
+
+// NewCycle Start the new checker cycle, the plugins are revalidated on the next Get
+func (p *PluginCache) NewCycle() {
+	p.Mutex.Lock()
+	defer p.Mutex.Unlock()
+	p.Cycle++
+}
+
+// entry Return the cache entry of the url, the entry is created if not exists
+func (p *PluginCache) entry(url string) (*CachedPlugin, int) {
+	p.Mutex.Lock()
+	defer p.Mutex.Unlock()
+	cached, ok := p.Plugins[url]
+	if !ok {
+		cached = &CachedPlugin{Url: url}
+		p.Plugins[url] = cached
+	}
+	return cached, p.Cycle
+}
+
+// Get Return the plugin source from the cache
+// The plugin is downloaded once per cycle with If-None-Match and If-Modified-Since headers
+func (p *PluginCache) Get(url string) (CachedPlugin, error) {
+	cached, cycle := p.entry(url)
+	cached.mutex.Lock()
+	defer cached.mutex.Unlock()
+	if cached.cycle == cycle && cached.Content != nil {
+		return cached.snapshot(), nil
+	}
+	header := http.Header{}
+	if cached.Content != nil {
+		if cached.ETag != "" {
+			header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+	statusCode, respHeader, body, err := GetUrlWithHeaders("json", url, header)
+	if err != nil {
+		return CachedPlugin{}, err
+	}
+	switch statusCode {
+	case http.StatusNotModified:
+		log.Logger.Debugln("Plugin", url, "is not modified")
+	case http.StatusOK:
+		cached.Content = body
+		cached.Size = len(body)
+		cached.Sha256 = Sha256Hex(body)
+		cached.Md5 = CheckMkPlugin{ByteContent: body}.CalculateMd5()
+		cached.ETag = respHeader.Get("ETag")
+		cached.LastModified = respHeader.Get("Last-Modified")
+		cached.FetchedAt = time.Now()
+	default:
+		return CachedPlugin{}, fmt.Errorf("status code error: %d %s", statusCode, http.StatusText(statusCode))
+	}
+	cached.cycle = cycle
+	return cached.snapshot(), nil
+}
+
+// snapshot Return copy of the entry without the mutex, must be called under the entry lock
+func (c *CachedPlugin) snapshot() CachedPlugin {
+	return CachedPlugin{
+		Url:          c.Url,
+		Content:      c.Content,
+		Size:         c.Size,
+		Sha256:       c.Sha256,
+		Md5:          c.Md5,
+		ETag:         c.ETag,
+		LastModified: c.LastModified,
+		FetchedAt:    c.FetchedAt,
+	}
+}
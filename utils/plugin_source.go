@@ -0,0 +1,120 @@
+package utils
+
+import (
+	"cmk_getter/config"
+	"cmk_getter/log"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Sources of the plugins
+const (
+	// SourceAuto Local override if exists, otherwise the Check_MK server
+	SourceAuto = ""
+	// SourceUpstream Check_MK server only
+	SourceUpstream = "upstream"
+	// SourceLocal Local plugins folder or git checkout only
+	SourceLocal = "local"
+	// SourceUrl Arbitrary HTTP url of the plugin
+	SourceUrl = "url"
+)
+
+// GetLocalPluginFolders Return folders with local plugin overrides in the lookup order
+func GetLocalPluginFolders() []string {
+	var folders []string
+	if config.ConfigCmkGetter.PluginsFolder != "" {
+		folders = append(folders, config.ConfigCmkGetter.PluginsFolder)
+	}
+	if config.ConfigCmkGetter.PluginsGitPath != "" {
+		folders = append(folders, config.ConfigCmkGetter.PluginsGitPath)
+	}
+	return folders
+}
+
+// readLocalPlugin Read the plugin from the local plugin folders
+// Return os.ErrNotExist if the plugin is not found in any folder
+func readLocalPlugin(name string) ([]byte, error) {
+	for _, folder := range GetLocalPluginFolders() {
+		content, err := os.ReadFile(filepath.Join(folder, filepath.Base(name)))
+		if err == nil {
+			return content, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("plugin %s not found in local plugin folders: %w", name, os.ErrNotExist)
+}
+
+// IsCheckMkUrl Check if the url is on the Check_MK server, only such urls get the credentials
+func IsCheckMkUrl(url string) bool {
+	return strings.HasPrefix(url, fmt.Sprintf("https://%s/", config.ConfigCmkGetter.Domain))
+}
+
+// getPluginSource Read the plugin content from the configured source
+func getPluginSource(c *CheckMkPlugin) error {
+	switch c.Source {
+	case SourceAuto, SourceLocal:
+		content, err := readLocalPlugin(c.Name)
+		if err == nil {
+			c.ByteContent = content
+			c.Sha256 = c.CalculateSha256()
+			c.Md5 = c.CalculateMd5()
+			return nil
+		}
+		// The error is wrapped, os.IsNotExist does not unwrap it
+		if c.Source == SourceLocal || !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return getCachedPlugin(c, c.CreateUrl())
+	case SourceUpstream:
+		return getCachedPlugin(c, c.CreateUrl())
+	case SourceUrl:
+		if c.Url == "" {
+			return fmt.Errorf("no url for plugin %s", c.Name)
+		}
+		return getCachedPlugin(c, c.Url)
+	default:
+		return fmt.Errorf("unknown source %s of plugin %s", c.Source, c.Name)
+	}
+}
+
+// getCachedPlugin Set the plugin content from the shared plugin cache
+func getCachedPlugin(c *CheckMkPlugin, url string) error {
+	cached, err := PluginSources.Get(url)
+	if err != nil {
+		return err
+	}
+	c.ByteContent = cached.Content
+	c.Sha256 = cached.Sha256
+	c.Md5 = cached.Md5
+	return nil
+}
+
+// ErrChecksumMismatch Plugin content differs from the pinned sha256
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// checkPinnedSha256 Compare the plugin content with the pinned checksum
+func checkPinnedSha256(c CheckMkPlugin) error {
+	if c.PinnedSha256 == "" || strings.EqualFold(c.PinnedSha256, c.Sha256) {
+		return nil
+	}
+	return fmt.Errorf("%w of plugin %s: expected %s, got %s", ErrChecksumMismatch, c.Name, c.PinnedSha256, c.Sha256)
+}
+
+// PullPluginsGit Update the git checkout with the local plugins if enabled
+func PullPluginsGit() {
+	if config.ConfigCmkGetter.PluginsGitPath == "" || !config.ConfigCmkGetter.PluginsGitPull {
+		return
+	}
+	output, err := exec.Command("git", "-C", config.ConfigCmkGetter.PluginsGitPath, "pull", "--ff-only").CombinedOutput()
+	if err != nil {
+		log.Logger.Errorln("Error pulling plugins git checkout:", err, strings.TrimSpace(string(output)))
+		return
+	}
+	log.Logger.Debugln("Plugins git checkout updated:", strings.TrimSpace(string(output)))
+}
@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"cmk_getter/config"
+	"cmk_getter/log"
+	"errors"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// remoteHashTimeout Timeout of the sha256sum run on the node
+const remoteHashTimeout = 30 * time.Second
+
+// sha256Regexp Hash in the sha256sum output
+var sha256Regexp = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// RemoteFileState Size, modification time and sha256 of the file on the node
+type RemoteFileState struct {
+	Exists  bool
+	Size    int64
+	ModTime time.Time
+	// Sha256 is empty if the size differs from the source, the file is drifted anyway
+	Sha256 string
+}
+
+// ShellQuote Quote the string for the remote shell
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// remoteSha256 Calculate the sha256 of the file with sha256sum on the node
+func remoteSha256(sshClient *ssh.Client, filePath string) (string, error) {
+	stdout, stderr, exitCode, err := RunCommandTimeout(sshClient, "sha256sum -- "+ShellQuote(filePath), remoteHashTimeout)
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(stdout)
+	if exitCode != 0 || len(fields) == 0 || !sha256Regexp.MatchString(fields[0]) {
+		return "", errors.New("sha256sum failed: " + strings.TrimSpace(stderr))
+	}
+	return fields[0], nil
+}
+
+// StatPluginFile Return the state of the plugin file on the node
+// The hash is reused from the previous check if the size and modification time are the same,
+// not calculated if the size differs from the source and calculated with sha256sum on the node
+// if RemoteHash is set, with fallback to reading the file over SFTP
+func StatPluginFile(sshClient *ssh.Client, sftpClient *sftp.Client, filePath string, c, previous CheckMkPlugin) (RemoteFileState, error) {
+	info, err := sftpClient.Stat(filePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return RemoteFileState{}, nil
+		}
+		return RemoteFileState{}, err
+	}
+	state := RemoteFileState{Exists: true, Size: info.Size(), ModTime: info.ModTime()}
+	if previous.NodeSha256 != "" && previous.NodeSize == state.Size && previous.NodeModTime.Equal(state.ModTime) {
+		state.Sha256 = previous.NodeSha256
+		return state, nil
+	}
+	if state.Size != int64(len(c.ByteContent)) {
+		return state, nil
+	}
+	if config.ConfigCmkGetter.RemoteHash {
+		state.Sha256, err = remoteSha256(sshClient, filePath)
+		if err == nil {
+			return state, nil
+		}
+		log.Logger.Debugln("Error calculating hash on the node, reading the file:", err)
+	}
+	content, err := readRemoteFile(sftpClient, filePath)
+	if err != nil {
+		return state, err
+	}
+	state.Sha256 = Sha256Hex(content)
+	return state, nil
+}
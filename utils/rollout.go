@@ -0,0 +1,466 @@
+package utils
+
+import (
+	"cmk_getter/log"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Rollout statuses
+const (
+	RolloutRunning   = "running"
+	RolloutPaused    = "paused"
+	RolloutCompleted = "completed"
+)
+
+// rolloutConcurrency Number of nodes upgraded at the same time in a wave
+const rolloutConcurrency = 10
+
+// rolloutsState Name of the state file with rollouts
+const rolloutsState = "rollouts"
+
+// RolloutRequest Plan of the staged agent rollout
+type RolloutRequest struct {
+	// Hosts upgraded in the first wave
+	Canary []string `json:"canary"`
+	// Cumulative percentages of the other nodes for the next waves, for example [10, 50, 100]
+	Percentages []int `json:"percentages"`
+	// Part of failed nodes in a wave (0-1) which pauses the rollout
+	FailureThreshold float64 `json:"failure_threshold"`
+	// Nodes for the rollout, all ssh nodes if empty
+	Nodes []string `json:"nodes"`
+	// User who started the rollout, set by the API
+	Actor string `json:"-"`
+}
+
+// RolloutNodeResult Result of the agent upgrade and verification on the node
+type RolloutNodeResult struct {
+	Host    string    `json:"host"`
+	Time    time.Time `json:"time"`
+	Success bool      `json:"success"`
+	Skipped bool      `json:"skipped,omitempty"`
+	Version string    `json:"version,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// RolloutWave Group of nodes upgraded together
+type RolloutWave struct {
+	Name    string                       `json:"name"`
+	Hosts   []string                     `json:"hosts"`
+	Results map[string]RolloutNodeResult `json:"results"`
+	Done    bool                         `json:"done"`
+}
+
+// Rollout Staged agent rollout with canary wave and waves of the other nodes
+type Rollout struct {
+	Id      string `json:"id"`
+	Version string `json:"version"`
+	// Packages Agent packages pinned when the rollout is created, installed in every wave
+	Packages         AgentPackages `json:"packages"`
+	Status           string        `json:"status"`
+	FailureThreshold float64       `json:"failure_threshold"`
+	Waves            []RolloutWave `json:"waves"`
+	CurrentWave      int           `json:"current_wave"`
+	Error            string        `json:"error,omitempty"`
+	// User who started the rollout, actor of the agent installs in the audit log
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// pauseRequested stops the rollout after the current wave
+	pauseRequested bool
+}
+
+// RolloutMap Rollouts by id with mutex
+type RolloutMap struct {
+	Rollouts map[string]*Rollout
+	Mutex    sync.Mutex
+}
+
+// Rollouts Global map of the agent rollouts
+var Rollouts = &RolloutMap{
+	Rollouts: make(map[string]*Rollout),
+}
+
+// save Save the rollouts to the state file, must be called under the lock
+func (m *RolloutMap) save() {
+	err := SaveState(rolloutsState, m.Rollouts)
+	if err != nil {
+		log.Logger.Errorln("Error saving rollouts:", err)
+	}
+}
+
+// List Return copies of all rollouts sorted by creation time
+func (m *RolloutMap) List() []Rollout {
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+	list := []Rollout{}
+	for _, rollout := range m.Rollouts {
+		list = append(list, rollout.copy())
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	return list
+}
+
+// Get Return copy of the rollout by id
+func (m *RolloutMap) Get(id string) (Rollout, bool) {
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+	rollout, ok := m.Rollouts[id]
+	if !ok {
+		return Rollout{}, false
+	}
+	return rollout.copy(), true
+}
+
+// copy Return deep copy of the rollout, must be called under the lock
+func (r *Rollout) copy() Rollout {
+	c := *r
+	c.Waves = make([]RolloutWave, len(r.Waves))
+	for i, wave := range r.Waves {
+		c.Waves[i] = wave
+		c.Waves[i].Results = make(map[string]RolloutNodeResult, len(wave.Results))
+		for host, result := range wave.Results {
+			c.Waves[i].Results[host] = result
+		}
+	}
+	return c
+}
+
+// PlanWaves Split the nodes to the canary wave and waves by cumulative percentages
+func PlanWaves(nodes, canary []string, percentages []int) []RolloutWave {
+	var waves []RolloutWave
+	isCanary := make(map[string]bool)
+	if len(canary) > 0 {
+		waves = append(waves, RolloutWave{Name: "canary", Hosts: canary})
+		for _, host := range canary {
+			isCanary[host] = true
+		}
+	}
+	var rest []string
+	for _, host := range nodes {
+		if !isCanary[host] {
+			rest = append(rest, host)
+		}
+	}
+	sort.Strings(rest)
+	if len(percentages) == 0 || percentages[len(percentages)-1] < 100 {
+		percentages = append(percentages, 100)
+	}
+	start := 0
+	for _, percentage := range percentages {
+		if percentage > 100 {
+			percentage = 100
+		}
+		end := int(math.Ceil(float64(len(rest)) * float64(percentage) / 100))
+		if end <= start {
+			continue
+		}
+		waves = append(waves, RolloutWave{
+			Name:  fmt.Sprintf("%d%%", percentage),
+			Hosts: rest[start:end],
+		})
+		start = end
+	}
+	for i := range waves {
+		waves[i].Results = make(map[string]RolloutNodeResult)
+	}
+	return waves
+}
+
+// runningRollout Return the id of the running rollout, must be called under the lock
+func (m *RolloutMap) runningRollout() (string, bool) {
+	for id, rollout := range m.Rollouts {
+		if rollout.Status == RolloutRunning {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// CreateRollout Create the rollout of the latest downloaded agent package and start it
+// The package path and sha256 are pinned, so a newer package downloaded during the rollout is not installed
+// Only one rollout runs at the same time
+func CreateRollout(req RolloutRequest) (Rollout, error) {
+	if req.FailureThreshold < 0 || req.FailureThreshold > 1 {
+		return Rollout{}, fmt.Errorf("failure_threshold must be between 0 and 1")
+	}
+	CheckMkNodeMap.Mutex.Lock()
+	for _, host := range req.Canary {
+		if _, ok := CheckMkNodeMap.Nodes[host]; !ok {
+			CheckMkNodeMap.Mutex.Unlock()
+			return Rollout{}, fmt.Errorf("unknown canary node %s", host)
+		}
+	}
+	CheckMkNodeMap.Mutex.Unlock()
+	packages, err := LatestAgentPackages()
+	if err != nil {
+		return Rollout{}, fmt.Errorf("no agent package for the rollout: %s", err)
+	}
+	if packages.Version() == "" {
+		return Rollout{}, fmt.Errorf("unknown agent version of the packages in %s", GetAgentPackageFolder())
+	}
+	nodes := req.Nodes
+	if len(nodes) == 0 {
+		CheckMkNodeMap.Mutex.Lock()
+		for host := range CheckMkNodeMap.Nodes {
+			nodes = append(nodes, host)
+		}
+		CheckMkNodeMap.Mutex.Unlock()
+	}
+	waves := PlanWaves(nodes, req.Canary, req.Percentages)
+	if len(waves) == 0 {
+		return Rollout{}, fmt.Errorf("no nodes for the rollout")
+	}
+	now := time.Now()
+	rollout := &Rollout{
+		Id:               fmt.Sprintf("%d", now.UnixNano()),
+		Version:          packages.Version(),
+		Packages:         packages,
+		Status:           RolloutRunning,
+		FailureThreshold: req.FailureThreshold,
+		Waves:            waves,
+		CreatedBy:        req.Actor,
+		CreatedAt:        now,
+		UpdatedAt:        now,
+	}
+	Rollouts.Mutex.Lock()
+	if id, ok := Rollouts.runningRollout(); ok {
+		Rollouts.Mutex.Unlock()
+		return Rollout{}, fmt.Errorf("rollout %s is running", id)
+	}
+	Rollouts.Rollouts[rollout.Id] = rollout
+	Rollouts.save()
+	created := rollout.copy()
+	Rollouts.Mutex.Unlock()
+
+	log.WithVersion(rollout.Version).Infoln("Start rollout", rollout.Id, "of agent", rollout.Version)
+	go runRollout(rollout)
+	return created, nil
+}
+
+// PauseRollout Pause the running rollout after the current wave
+func PauseRollout(id string) error {
+	Rollouts.Mutex.Lock()
+	defer Rollouts.Mutex.Unlock()
+	rollout, ok := Rollouts.Rollouts[id]
+	if !ok {
+		return fmt.Errorf("rollout %s not found", id)
+	}
+	if rollout.Status != RolloutRunning {
+		return fmt.Errorf("rollout %s is %s", id, rollout.Status)
+	}
+	rollout.pauseRequested = true
+	return nil
+}
+
+// ResumeRollout Continue the paused rollout from the current wave
+func ResumeRollout(id string) error {
+	Rollouts.Mutex.Lock()
+	defer Rollouts.Mutex.Unlock()
+	rollout, ok := Rollouts.Rollouts[id]
+	if !ok {
+		return fmt.Errorf("rollout %s not found", id)
+	}
+	if rollout.Status != RolloutPaused {
+		return fmt.Errorf("rollout %s is %s", id, rollout.Status)
+	}
+	if len(rollout.Packages) == 0 {
+		return fmt.Errorf("rollout %s has no pinned agent package", id)
+	}
+	if running, ok := Rollouts.runningRollout(); ok {
+		return fmt.Errorf("rollout %s is running", running)
+	}
+	// Failed wave is continued with the next one, failed nodes stay in the results
+	if rollout.CurrentWave < len(rollout.Waves) && rollout.Waves[rollout.CurrentWave].Done {
+		rollout.CurrentWave++
+	}
+	rollout.Status = RolloutRunning
+	rollout.Error = ""
+	rollout.UpdatedAt = time.Now()
+	Rollouts.save()
+	log.Logger.Infoln("Resume rollout", rollout.Id)
+	go runRollout(rollout)
+	return nil
+}
+
+// runRollout Upgrade the waves of the rollout one by one
+func runRollout(rollout *Rollout) {
+	for {
+		Rollouts.Mutex.Lock()
+		if rollout.Status != RolloutRunning {
+			Rollouts.Mutex.Unlock()
+			return
+		}
+		if rollout.CurrentWave >= len(rollout.Waves) {
+			rollout.Status = RolloutCompleted
+			rollout.UpdatedAt = time.Now()
+			Rollouts.save()
+			Rollouts.Mutex.Unlock()
+			log.Logger.Infoln("Rollout", rollout.Id, "completed")
+			return
+		}
+		wave := rollout.Waves[rollout.CurrentWave]
+		// Nodes with results from the previous run are not upgraded again
+		var pending []string
+		for _, host := range wave.Hosts {
+			if _, ok := wave.Results[host]; !ok {
+				pending = append(pending, host)
+			}
+		}
+		Rollouts.Mutex.Unlock()
+
+		log.Logger.Infoln("Rollout", rollout.Id, "wave", wave.Name, "on", len(pending), "nodes")
+		failed := runRolloutWave(rollout, pending)
+
+		Rollouts.Mutex.Lock()
+		rollout.Waves[rollout.CurrentWave].Done = true
+		rollout.UpdatedAt = time.Now()
+		if len(wave.Hosts) > 0 && float64(failed)/float64(len(wave.Hosts)) > rollout.FailureThreshold {
+			rollout.Status = RolloutPaused
+			rollout.Error = fmt.Sprintf("%d of %d nodes failed in wave %s", failed, len(wave.Hosts), wave.Name)
+			log.Logger.Infoln("Rollout", rollout.Id, "paused:", rollout.Error)
+		} else if rollout.pauseRequested {
+			rollout.Status = RolloutPaused
+			rollout.CurrentWave++
+		} else {
+			rollout.CurrentWave++
+		}
+		rollout.pauseRequested = false
+		Rollouts.save()
+		Rollouts.Mutex.Unlock()
+	}
+}
+
+// runRolloutWave Upgrade and verify the agent on the hosts of the current wave
+// Return the number of failed nodes in the wave
+func runRolloutWave(rollout *Rollout, hosts []string) int {
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, rolloutConcurrency)
+	for _, host := range hosts {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() {
+				<-semaphore
+			}()
+			result := upgradeRolloutNode(rollout.Packages, rollout.CreatedBy, host)
+			Rollouts.Mutex.Lock()
+			defer Rollouts.Mutex.Unlock()
+			rollout.Waves[rollout.CurrentWave].Results[host] = result
+			rollout.UpdatedAt = time.Now()
+			Rollouts.save()
+		}(host)
+	}
+	wg.Wait()
+
+	Rollouts.Mutex.Lock()
+	defer Rollouts.Mutex.Unlock()
+	failed := 0
+	for _, result := range rollout.Waves[rollout.CurrentWave].Results {
+		if !result.Success {
+			failed++
+		}
+	}
+	return failed
+}
+
+// upgradeRolloutNode Install the pinned agent package on the node and verify the agent output
+func upgradeRolloutNode(packages AgentPackages, actor, host string) RolloutNodeResult {
+	result := RolloutNodeResult{Host: host, Time: time.Now()}
+	node, ok := CheckMkNodeMap.GetAvailableNode(host)
+	if !ok {
+		result.Error = "node is not available"
+		return result
+	}
+	// Node is already upgraded
+	version := packages.Version()
+	if node.AgentVersion == version {
+		result.Skipped = true
+	} else {
+		install := node.InstallAgentPackages(packages)
+		Audit.Add(AgentInstallEntry(actor, host, install))
+		if !install.Success {
+			result.Error = install.Error
+			return result
+		}
+		result.Version = install.Version
+		if install.Version != version {
+			result.Error = fmt.Sprintf("installed agent version is %s, expected %s", install.Version, version)
+			return result
+		}
+	}
+	err := node.VerifyAgent()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Success = true
+	return result
+}
+
+// ResumeRollouts Load rollouts from the state file and continue the running ones
+// Rollouts are continued after the first ssh status check of the nodes
+func ResumeRollouts() {
+	running, err := LoadRollouts()
+	if err != nil {
+		log.Logger.Errorln("Error loading rollouts:", err)
+		return
+	}
+	if len(running) == 0 {
+		return
+	}
+	<-SSHStatusChecked
+	ContinueRollouts(running)
+}
+
+// LoadRollouts Load rollouts from the state file and return the ids of the running ones
+// Running rollouts saved without the pinned packages are paused
+func LoadRollouts() ([]string, error) {
+	Rollouts.Mutex.Lock()
+	defer Rollouts.Mutex.Unlock()
+	err := LoadState(rolloutsState, &Rollouts.Rollouts)
+	if Rollouts.Rollouts == nil {
+		Rollouts.Rollouts = make(map[string]*Rollout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var running []string
+	for _, rollout := range Rollouts.Rollouts {
+		if rollout.Status != RolloutRunning {
+			continue
+		}
+		// Rollouts saved before the package was pinned can not know which package to install
+		if len(rollout.Packages) == 0 {
+			rollout.Status = RolloutPaused
+			rollout.Error = "no pinned agent package, create a new rollout"
+			rollout.UpdatedAt = time.Now()
+			log.Logger.Infoln("Rollout", rollout.Id, "paused:", rollout.Error)
+			Rollouts.save()
+			continue
+		}
+		running = append(running, rollout.Id)
+	}
+	return running, nil
+}
+
+// ContinueRollouts Continue the running rollouts from the saved wave
+// Nodes with results in the saved wave are not upgraded again
+func ContinueRollouts(ids []string) {
+	Rollouts.Mutex.Lock()
+	defer Rollouts.Mutex.Unlock()
+	for _, id := range ids {
+		rollout, ok := Rollouts.Rollouts[id]
+		if !ok || rollout.Status != RolloutRunning {
+			continue
+		}
+		log.Logger.Infoln("Continue rollout", rollout.Id)
+		go runRollout(rollout)
+	}
+}
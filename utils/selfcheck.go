@@ -0,0 +1,213 @@
+package utils
+
+import (
+	"cmk_getter/config"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// States of the Check_MK services
+const (
+	StateOk      = 0
+	StateWarn    = 1
+	StateCrit    = 2
+	StateUnknown = 3
+)
+
+// Default thresholds of the self-monitoring services
+const (
+	defaultUnreachableWarn = 1
+	defaultUnreachableCrit = 5
+	defaultDriftedWarn     = 1
+	defaultDriftedCrit     = 10
+)
+
+// LocalCheck Service in the Check_MK local check format
+type LocalCheck struct {
+	State   int
+	Service string
+	// Metrics as name=value;warn;crit, "-" if empty
+	Metrics []string
+	Text    string
+}
+
+// String Return the local check line
+func (l LocalCheck) String() string {
+	metrics := "-"
+	if len(l.Metrics) > 0 {
+		metrics = strings.Join(l.Metrics, "|")
+	}
+	return fmt.Sprintf("%d \"%s\" %s %s", l.State, l.Service, metrics, l.Text)
+}
+
+// thresholdOrDefault Return the configured threshold or the default if not set
+func thresholdOrDefault(value, def int) int {
+	if value == 0 {
+		return def
+	}
+	return value
+}
+
+// ThresholdState Return the state of the value by the warn and crit thresholds
+// Negative threshold disables it
+func ThresholdState(value, warn, crit int) int {
+	switch {
+	case crit > 0 && value >= crit:
+		return StateCrit
+	case warn > 0 && value >= warn:
+		return StateWarn
+	default:
+		return StateOk
+	}
+}
+
+// metric Return the metric with the thresholds, disabled thresholds are empty
+func metric(name string, value, warn, crit int) string {
+	threshold := func(t int) string {
+		if t <= 0 {
+			return ""
+		}
+		return fmt.Sprintf("%d", t)
+	}
+	return fmt.Sprintf("%s=%d;%s;%s", name, value, threshold(warn), threshold(crit))
+}
+
+// agentDownloadCheck Check that the agent of CurrentVersion is downloaded to all folders
+// and the version was checked recently
+func agentDownloadCheck(version string, lastCheck time.Time, polling time.Duration, folders []string) LocalCheck {
+	check := LocalCheck{Service: "cmk_getter agent download"}
+	if version == "" {
+		check.State = StateUnknown
+		check.Text = "Agent version is not checked yet"
+		return check
+	}
+	var missing []string
+	for _, folder := range folders {
+		files, err := GetFiles(folder)
+		found := false
+		for _, file := range files {
+			if strings.Contains(file, version) {
+				found = true
+				break
+			}
+		}
+		if err != nil || !found {
+			missing = append(missing, folder)
+		}
+	}
+	switch {
+	case len(missing) > 0:
+		check.State = StateCrit
+		check.Text = fmt.Sprintf("Agent %s is not downloaded to %s", version, strings.Join(missing, ", "))
+	case polling > 0 && time.Since(lastCheck) > stalledIntervals*polling:
+		check.State = StateWarn
+		check.Text = fmt.Sprintf("Agent %s downloaded, last successful version check %s", version, formatCheckTime(lastCheck))
+	default:
+		check.Text = fmt.Sprintf("Agent %s downloaded to %d folders", version, len(folders))
+	}
+	return check
+}
+
+// formatCheckTime Return the time of the check or never
+func formatCheckTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Format(time.RFC3339)
+}
+
+// countPlugins Return the drifted and failing plugins and local checks of the node
+func countPlugins(node CheckMkNode) ([]string, []string) {
+	var drifted, failing []string
+	for _, c := range append(append([]CheckMkPlugin{}, node.Plugins...), node.LocalChecks...) {
+		switch c.Status {
+		case PluginDrifted:
+			drifted = append(drifted, c.Name)
+		case PluginFailing:
+			failing = append(failing, c.Name)
+		}
+	}
+	return drifted, failing
+}
+
+// pluginsCheck Return the local check of the drifted and failing plugins
+func pluginsCheck(service string, drifted, failing []string, names bool, warn, crit int) LocalCheck {
+	check := LocalCheck{
+		Service: service,
+		State:   ThresholdState(len(drifted)+len(failing), warn, crit),
+		Metrics: []string{metric("drifted", len(drifted), warn, crit), metric("failing", len(failing), 0, 0)},
+		Text:    fmt.Sprintf("%d drifted, %d failing plugins", len(drifted), len(failing)),
+	}
+	if names && len(drifted) > 0 {
+		check.Text += ", drifted: " + strings.Join(drifted, ", ")
+	}
+	if names && len(failing) > 0 {
+		check.Text += ", failing: " + strings.Join(failing, ", ")
+	}
+	return check
+}
+
+// SelfCheckOutput Return the agent output with the local checks of cmk_getter
+// With piggyback enabled the plugin drift of each node is reported in the piggyback data of the node
+func SelfCheckOutput(nodes []CheckMkNode) string {
+	cfg := config.ConfigCmkGetter.SelfCheck
+	unreachableWarn := thresholdOrDefault(cfg.UnreachableWarn, defaultUnreachableWarn)
+	unreachableCrit := thresholdOrDefault(cfg.UnreachableCrit, defaultUnreachableCrit)
+	driftedWarn := thresholdOrDefault(cfg.DriftedWarn, defaultDriftedWarn)
+	driftedCrit := thresholdOrDefault(cfg.DriftedCrit, defaultDriftedCrit)
+
+	var unreachable, allDrifted, allFailing []string
+	for _, node := range nodes {
+		if !node.IsAvailable {
+			unreachable = append(unreachable, node.Host)
+		}
+		drifted, failing := countPlugins(node)
+		for _, name := range drifted {
+			allDrifted = append(allDrifted, node.Host+"/"+name)
+		}
+		for _, name := range failing {
+			allFailing = append(allFailing, node.Host+"/"+name)
+		}
+	}
+	sort.Strings(unreachable)
+
+	nodesCheck := LocalCheck{
+		Service: "cmk_getter SSH nodes",
+		State:   ThresholdState(len(unreachable), unreachableWarn, unreachableCrit),
+		Metrics: []string{metric("unreachable", len(unreachable), unreachableWarn, unreachableCrit), metric("nodes", len(nodes), 0, 0)},
+		Text:    fmt.Sprintf("%d of %d nodes unreachable by SSH", len(unreachable), len(nodes)),
+	}
+	if len(unreachable) > 0 {
+		nodesCheck.Text += ": " + strings.Join(unreachable, ", ")
+	}
+
+	var output strings.Builder
+	output.WriteString("<<<local:sep(0)>>>\n")
+	polling := time.Duration(config.ConfigCmkGetter.Polling) * time.Second
+	for _, check := range []LocalCheck{
+		agentDownloadCheck(CurrentVersion, Metrics.LastVersionCheck(), polling, config.ConfigCmkGetter.Folders),
+		nodesCheck,
+		pluginsCheck("cmk_getter plugins", allDrifted, allFailing, false, driftedWarn, driftedCrit),
+	} {
+		output.WriteString(check.String() + "\n")
+	}
+	if !cfg.Piggyback {
+		return output.String()
+	}
+
+	for _, node := range nodes {
+		sshCheck := LocalCheck{Service: "cmk_getter SSH", Text: "SSH is available for cmk_getter"}
+		if !node.IsAvailable {
+			sshCheck.State = StateCrit
+			sshCheck.Text = "SSH is not available for cmk_getter"
+		}
+		drifted, failing := countPlugins(node)
+		output.WriteString("<<<<" + node.Host + ">>>>\n<<<local:sep(0)>>>\n")
+		output.WriteString(sshCheck.String() + "\n")
+		output.WriteString(pluginsCheck("cmk_getter plugins", drifted, failing, true, driftedWarn, driftedCrit).String() + "\n")
+		output.WriteString("<<<<>>>>\n")
+	}
+	return output.String()
+}
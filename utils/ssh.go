@@ -6,32 +6,86 @@ import (
 	"cmk_getter/config"
 	"cmk_getter/log"
 	"crypto/md5"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
+// Kinds of artifacts deployed to the nodes
+const (
+	// KindPlugin Agent plugin from the Check_MK server
+	KindPlugin = "plugin"
+	// KindLocal Local check from the cmk_getter local checks folder
+	KindLocal = "local"
+)
+
 type CheckMkPlugin struct {
-	Name        string `json:"name"`
-	IsActual    bool   `json:"is_actual"`
-	Url         string `json:",omitempty"`
-	ByteContent []byte `json:",omitempty"`
+	Name     string `json:"name"`
+	IsActual bool   `json:"is_actual"`
+	Interval int    `json:"interval,omitempty"`
+	Kind     string `json:"kind,omitempty"`
+	// Source of the plugin: upstream, local or url, local override or upstream if empty
+	Source       string `json:"source,omitempty"`
+	PinnedSha256 string `json:"pinned_sha256,omitempty"`
+	// Expected <<<section>>> header in the plugin output
+	Section string `json:"section,omitempty"`
+	// Status of the plugin on the node: deployed, failing or drifted
+	Status       string              `json:"status"`
+	Verification *PluginVerification `json:"verification,omitempty"`
+	// Hashes of the plugin source and the sha256 of the plugin on the node
+	Sha256     string `json:"sha256,omitempty"`
+	Md5        string `json:"md5,omitempty"`
+	NodeSha256 string `json:"node_sha256,omitempty"`
+	// Size and modification time of the plugin on the node to skip hashing of unchanged files
+	NodeSize    int64     `json:"node_size,omitempty"`
+	NodeModTime time.Time `json:"node_mod_time,omitempty"`
+	Url         string    `json:",omitempty"`
+	ByteContent []byte    `json:",omitempty"`
 }
 
 type CheckMkNode struct {
-	Host         string          `json:"host"`
-	Port         string          `json:",omitempty"`
-	PluginFolder string          `json:",omitempty"`
-	Plugins      []CheckMkPlugin `json:"plugins"`
+	Host         string `json:"host"`
+	Port         string `json:",omitempty"`
+	PluginFolder string `json:",omitempty"`
+	LocalFolder  string `json:",omitempty"`
+	// Folder and labels of the host in the Check_MK config
+	Folder      string            `json:"folder"`
+	Labels      map[string]string `json:"labels"`
+	Plugins     []CheckMkPlugin   `json:"plugins"`
+	LocalChecks []CheckMkPlugin   `json:"local_checks"`
+	// Files in the plugin folders which are not in the plugins list
+	UnmanagedPlugins []string `json:"unmanaged_plugins"`
+	// Files in the local folders which are not in the local checks list
+	UnmanagedLocalChecks []string `json:"unmanaged_local_checks"`
 	// SSH is available only for the cmk_getter
 	IsAvailable bool `json:"is_available"`
+	// Installed agent version and if it is the same as CurrentVersion
+	AgentVersion     string              `json:"agent_version"`
+	IsAgentActual    bool                `json:"is_agent_actual"`
+	LastAgentInstall *AgentInstallResult `json:"last_agent_install,omitempty"`
 }
 
 // PluginCheckerTrigger Channel for trigger for plugins check
-var PluginCheckerTrigger = make(chan bool)
+// One trigger is buffered to run the checker again if it is already running
+var PluginCheckerTrigger = make(chan bool, 1)
+
+// TriggerPluginChecker Trigger the plugin checker without waiting for it
+// The trigger is dropped if another one is already pending
+func TriggerPluginChecker() {
+	select {
+	case PluginCheckerTrigger <- true:
+	default:
+	}
+}
 
 // GetPluginFolder Return default plugin folder
 func (node CheckMkNode) GetPluginFolder() string {
@@ -41,6 +95,73 @@ func (node CheckMkNode) GetPluginFolder() string {
 	return node.PluginFolder
 }
 
+// GetLocalFolder Return default local checks folder
+func (node CheckMkNode) GetLocalFolder() string {
+	if node.LocalFolder == "" {
+		return "/usr/lib/check_mk_agent/local"
+	}
+	return node.LocalFolder
+}
+
+// GetBaseFolder Return plugin or local checks folder by the artifact kind
+func (node CheckMkNode) GetBaseFolder(kind string) string {
+	if kind == KindLocal {
+		return node.GetLocalFolder()
+	}
+	return node.GetPluginFolder()
+}
+
+// GetPluginFolderFor Return plugin folder for the plugin execution interval
+// Plugins with interval are placed in <plugin folder>/<interval> and run asynchronously by the agent
+func (node CheckMkNode) GetPluginFolderFor(c CheckMkPlugin) string {
+	if c.Interval > 0 {
+		return fmt.Sprintf("%s/%d", node.GetBaseFolder(c.Kind), c.Interval)
+	}
+	return node.GetBaseFolder(c.Kind)
+}
+
+// GetPluginPath Return full path of the plugin file on the node
+func (node CheckMkNode) GetPluginPath(c CheckMkPlugin) string {
+	return fmt.Sprintf("%s/%s", node.GetPluginFolderFor(c), c.Name)
+}
+
+// GetArtifacts Return plugins or local checks of the node by the artifact kind
+func (node CheckMkNode) GetArtifacts(kind string) []CheckMkPlugin {
+	if kind == KindLocal {
+		return node.LocalChecks
+	}
+	return node.Plugins
+}
+
+// FindArtifact Return the configured plugin or local check of the node by name
+// Unknown artifacts are returned with the name and kind only
+func (node CheckMkNode) FindArtifact(kind, name string) CheckMkPlugin {
+	for _, plugin := range node.GetArtifacts(kind) {
+		if plugin.Name == name {
+			return plugin
+		}
+	}
+	if kind == KindLocal {
+		return CheckMkPlugin{Name: name, Kind: KindLocal}
+	}
+	return CheckMkPlugin{Name: name}
+}
+
+// FindPlugin Return the configured plugin of the node by name
+func (node CheckMkNode) FindPlugin(name string) CheckMkPlugin {
+	return node.FindArtifact(KindPlugin, name)
+}
+
+// hasArtifact Check if the plugin or local check is in the node lists
+func (node CheckMkNode) hasArtifact(kind, name string) bool {
+	for _, plugin := range node.GetArtifacts(kind) {
+		if plugin.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
 // GetPort Return default port
 func (node CheckMkNode) GetPort() string {
 	if node.Port == "" {
@@ -56,19 +177,38 @@ func (c CheckMkPlugin) CreateUrl() string {
 	return fmt.Sprintf(PluginUrlTemplate, config.ConfigCmkGetter.Domain, config.ConfigCmkGetter.Site, c.Name)
 }
 
+// GetLocalChecksFolder Return the folder with local checks in the cmk_getter working dir
+func GetLocalChecksFolder() string {
+	if config.ConfigCmkGetter.LocalChecksFolder == "" {
+		return "local"
+	}
+	return config.ConfigCmkGetter.LocalChecksFolder
+}
+
 func GetPlugin(c *CheckMkPlugin) error {
-	// Get the plugin from the API as []byte
-	_, pluginResp, err := GetUrl("json", c.CreateUrl())
+	// Local checks are read from the local checks folder
+	if c.Kind == KindLocal {
+		content, err := os.ReadFile(filepath.Join(GetLocalChecksFolder(), filepath.Base(c.Name)))
+		if err != nil {
+			log.Logger.WithField(log.FieldPlugin, c.Name).Infoln("Error reading local check from", GetLocalChecksFolder()+":", err)
+			return err
+		}
+		c.ByteContent = content
+		c.Sha256 = c.CalculateSha256()
+		c.Md5 = c.CalculateMd5()
+		return nil
+	}
+	// Get the plugin from the configured source, downloaded plugins are shared between the nodes in the checker cycle
+	err := getPluginSource(c)
 	if err != nil {
-		log.Logger.Info("Error getting plugin from API")
+		log.Logger.WithField(log.FieldPlugin, c.Name).Infoln("Error getting plugin", c.Name, "from source:", err)
 		return err
 	}
-	// Set the byte content
-	c.ByteContent = pluginResp
-	return nil
+	return checkPinnedSha256(*c)
 }
 
 // CalculateMd5 Calculate the md5 hash of the plugin
+// Md5 is kept for the UI only, plugins are compared by sha256
 func (c CheckMkPlugin) CalculateMd5() string {
 	// Calculate the md5 hash of the plugin content
 	hashSum := md5.Sum(c.ByteContent)
@@ -76,6 +216,17 @@ func (c CheckMkPlugin) CalculateMd5() string {
 	return fmt.Sprintf("%x", hashSum)
 }
 
+// CalculateSha256 Calculate the sha256 hash of the plugin
+func (c CheckMkPlugin) CalculateSha256() string {
+	return Sha256Hex(c.ByteContent)
+}
+
+// Sha256Hex Return the sha256 hash of the content as a hex string
+func Sha256Hex(content []byte) string {
+	hashSum := sha256.Sum256(content)
+	return fmt.Sprintf("%x", hashSum)
+}
+
 // ReadRSAKey Read the RSA key from .ssh folder
 func ReadRSAKey() (ssh.Signer, error) {
 	// Read the RSA key from .ssh folder
@@ -122,172 +273,515 @@ func (node CheckMkNode) CreateSshClient() (*ssh.Client, error) {
 		Timeout: 5 * time.Second,
 	}
 	// Connect to the node
+	start := time.Now()
 	sshClient, err := ssh.Dial("tcp", fmt.Sprintf("%s:%s", node.Host, node.GetPort()), sshConfig)
+	Metrics.ObserveSSHDial(node.Host, time.Since(start), err)
 	if err != nil {
 		return nil, err
 	}
 	return sshClient, nil
 }
 
-// SendPlugin Send the plugin to the node with ssh if the md5 hash is different
-func (node CheckMkNode) SendPlugin(c CheckMkPlugin) error {
-	// Get the plugin from the API as []byte
-	err := GetPlugin(&c)
+// RunCommand Run the command in a new ssh session
+// Return stdout, stderr and the exit code of the command
+func RunCommand(sshClient *ssh.Client, command string) (string, string, int, error) {
+	session, err := sshClient.NewSession()
 	if err != nil {
-		log.Logger.Debugln("Error getting plugin from API")
-		return err
+		log.Logger.Debugln("Error creating ssh session:", err)
+		return "", "", -1, err
 	}
-	// Create the ssh client
-	sshClient, err := node.CreateSshClient()
+	defer func() {
+		_ = session.Close()
+	}()
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	err = session.Run(command)
 	if err != nil {
-		log.Logger.Debugln("Error creating ssh client:", err)
-		return err
+		var exitErr *ssh.ExitError
+		if errors.As(err, &exitErr) {
+			return stdout.String(), stderr.String(), exitErr.ExitStatus(), nil
+		}
+		return stdout.String(), stderr.String(), -1, err
+	}
+	return stdout.String(), stderr.String(), 0, nil
+}
+
+// RunCommandTimeout Run the command in a new ssh session and stop it after the timeout
+func RunCommandTimeout(sshClient *ssh.Client, command string, timeout time.Duration) (string, string, int, error) {
+	session, err := sshClient.NewSession()
+	if err != nil {
+		log.Logger.Debugln("Error creating ssh session:", err)
+		return "", "", -1, err
 	}
 	defer func() {
-		err := sshClient.Close()
-		if err != nil {
-			log.Logger.Traceln("Error closing ssh client:", err)
+		_ = session.Close()
+	}()
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Run(command)
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(timeout):
+		// Closing the session stops the command on the node
+		_ = session.Signal(ssh.SIGKILL)
+		_ = session.Close()
+		<-done
+		return stdout.String(), stderr.String(), -1, fmt.Errorf("command %q timed out after %s", command, timeout)
+	}
+	if err != nil {
+		var exitErr *ssh.ExitError
+		if errors.As(err, &exitErr) {
+			return stdout.String(), stderr.String(), exitErr.ExitStatus(), nil
 		}
+		return stdout.String(), stderr.String(), -1, err
+	}
+	return stdout.String(), stderr.String(), 0, nil
+}
+
+// readRemoteFile Read the file on the node
+func readRemoteFile(sftpClient *sftp.Client, filePath string) ([]byte, error) {
+	remoteFile, err := sftpClient.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = remoteFile.Close()
 	}()
-	// Create the sftp client
-	sftpClient, err := sftp.NewClient(sshClient)
+	// Convert *File object to []byte with reader and buffer
+	reader := bufio.NewReader(remoteFile)
+	buffer := bytes.NewBuffer(make([]byte, 0))
+	_, err = buffer.ReadFrom(reader)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// writePluginFile Replace the plugin file on the node with the content
+// The content is written to a hidden temporary file in the same folder and renamed into place,
+// so the agent never runs a partially written plugin
+func writePluginFile(sftpClient *sftp.Client, pluginPath string, content []byte) error {
+	tmpPath := path.Join(path.Dir(pluginPath), "."+path.Base(pluginPath)+".cmk_getter.tmp")
+	err := writeTmpPluginFile(sftpClient, tmpPath, content)
 	if err != nil {
-		log.Logger.Debugln("Error creating sftp client:", err)
+		_ = sftpClient.Remove(tmpPath)
+		return err
+	}
+	err = RenameRemoteFile(sftpClient, tmpPath, pluginPath)
+	if err != nil {
+		log.Logger.Debugln("Error renaming plugin file:", err)
+		_ = sftpClient.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// writeTmpPluginFile Write the content to the file, flush it and set permissions and ownership
+func writeTmpPluginFile(sftpClient *sftp.Client, tmpPath string, content []byte) error {
+	pluginFile, err := sftpClient.Create(tmpPath)
+	if err != nil {
+		log.Logger.Debugln("Error creating plugin file:", err)
 		return err
 	}
 	defer func() {
-		err := sftpClient.Close()
+		_ = pluginFile.Close()
+	}()
+	// Write the plugin content to the plugin file
+	_, err = pluginFile.Write(content)
+	if err != nil {
+		log.Logger.Debugln("Error writing plugin file:", err)
+		return err
+	}
+	// Flush the file to the disk if the server supports fsync
+	if _, ok := sftpClient.HasExtension("fsync@openssh.com"); ok {
+		err = pluginFile.Sync()
 		if err != nil {
-			log.Logger.Debugln("Error closing sftp client:", err)
+			log.Logger.Debugln("Error syncing plugin file:", err)
+			return err
 		}
-	}()
-	// Find the plugin file on the node
-	pluginFile, err := sftpClient.Open(fmt.Sprintf("%s/%s", node.GetPluginFolder(), c.Name))
+	}
+	// Set 755 permissions
+	err = pluginFile.Chmod(0755)
 	if err != nil {
-		log.Logger.Debugln("Error opening plugin file:", err)
-		// Create the plugin file
-		pluginFile, err = sftpClient.Create(fmt.Sprintf("%s/%s", node.GetPluginFolder(), c.Name))
+		log.Logger.Debugln("Error setting permissions:", err)
+		return err
 	}
-	// Convert *File object to []byte with reader and buffer
-	reader := bufio.NewReader(pluginFile)
-	buffer := bytes.NewBuffer(make([]byte, 0))
-	_, err = buffer.ReadFrom(reader)
+	err = pluginFile.Chown(config.ConfigCmkGetter.PluginUid, config.ConfigCmkGetter.PluginGid)
 	if err != nil {
-		log.Logger.Debugln("Error reading plugin file:", err)
+		log.Logger.Debugln("Error setting owner:", err)
 		return err
 	}
-	// Calculate the md5 hash of the plugin file on the node
-	hashSum := md5.Sum(buffer.Bytes())
-	// Encode the hash to a string
-	md5HashOnNode := fmt.Sprintf("%x", hashSum)
-	// Check if the md5 hash of the plugin file on the node is different
-	if md5HashOnNode != c.CalculateMd5() {
-		// Remove the plugin file on the node
-		err = sftpClient.Remove(fmt.Sprintf("%s/%s", node.GetPluginFolder(), c.Name))
+	return pluginFile.Close()
+}
+
+// RemoteRenamer Sftp calls used to replace the file on the node, implemented by *sftp.Client
+type RemoteRenamer interface {
+	HasExtension(name string) (string, bool)
+	PosixRename(oldPath, newPath string) error
+	Rename(oldPath, newPath string) error
+	Remove(path string) error
+}
+
+// RenameRemoteFile Replace newPath with oldPath atomically with posix-rename extension
+// Servers without the extension can not rename over the existing file, so it is moved aside first
+// and moved back if the rename fails. Between the two renames there is no file at newPath,
+// so the agent running at that moment does not run the plugin.
+func RenameRemoteFile(sftpClient RemoteRenamer, oldPath, newPath string) error {
+	if _, ok := sftpClient.HasExtension("posix-rename@openssh.com"); ok {
+		return sftpClient.PosixRename(oldPath, newPath)
+	}
+	asidePath := path.Join(path.Dir(newPath), "."+path.Base(newPath)+".cmk_getter.old")
+	err := sftpClient.Rename(newPath, asidePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	movedAside := err == nil
+	err = sftpClient.Rename(oldPath, newPath)
+	if err != nil {
+		if movedAside {
+			restoreErr := sftpClient.Rename(asidePath, newPath)
+			if restoreErr != nil {
+				return fmt.Errorf("%s, the old file is left in %s: %s", err, asidePath, restoreErr)
+			}
+		}
+		return err
+	}
+	if movedAside {
+		err = sftpClient.Remove(asidePath)
 		if err != nil {
-			log.Logger.Debugln("Error removing plugin file:", err)
-			return err
+			log.Logger.Debugln("Error removing old plugin file:", err)
 		}
-		// Create the plugin file on the node
-		pluginFile, err := sftpClient.Create(fmt.Sprintf("%s/%s", node.GetPluginFolder(), c.Name))
+	}
+	return nil
+}
+
+// Actions of SendPlugin with the plugin file on the node
+const (
+	// PluginReplaced Different file was backed up and replaced
+	PluginReplaced = "replaced"
+	// PluginCreated File did not exist on the node
+	PluginCreated = "created"
+	// PluginUnchanged File on the node is the same as the source
+	PluginUnchanged = "unchanged"
+)
+
+// PluginSendResult What SendPlugin did with the plugin file on the node
+type PluginSendResult struct {
+	Action string `json:"action"`
+	// Sha256 of the replaced file on the node, empty if the file was created
+	OldSha256 string `json:"old_sha256,omitempty"`
+	NewSha256 string `json:"new_sha256"`
+}
+
+// SendPlugin Send the plugin to the node with ssh if the sha256 hash is different
+func (node CheckMkNode) SendPlugin(c CheckMkPlugin) (PluginSendResult, error) {
+	// Get the plugin from the API as []byte
+	err := GetPlugin(&c)
+	if err != nil {
+		log.WithPlugin(node.Host, c.Name).Debugln("Error getting plugin from API")
+		return PluginSendResult{}, err
+	}
+	sshClient, sftpClient, err := node.CreateSftpClient()
+	if err != nil {
+		return PluginSendResult{}, err
+	}
+	defer func() {
+		err := sftpClient.Close()
 		if err != nil {
-			log.Logger.Debugln("Error creating plugin file:", err)
-			return err
+			log.WithPlugin(node.Host, c.Name).Debugln("Error closing sftp client:", err)
 		}
-		// Set 755 permissions
-		err = pluginFile.Chmod(0755)
+		err = sshClient.Close()
 		if err != nil {
-			log.Logger.Debugln("Error setting permissions:", err)
-			return err
+			log.WithPlugin(node.Host, c.Name).Traceln("Error closing ssh client:", err)
 		}
-		// Write the plugin content to the plugin file
-		_, err = pluginFile.Write(c.ByteContent)
+	}()
+	return node.SendPluginFile(sshClient, sftpClient, c)
+}
+
+// SendPluginFile Write the plugin content to the node if the sha256 hash is different
+// The replaced file is backed up, the backup of the missing file is removed, so it is not restored by the rollback
+// The ssh client is used only for the sha256sum on the node if RemoteHash is set
+func (node CheckMkNode) SendPluginFile(sshClient *ssh.Client, sftpClient *sftp.Client, c CheckMkPlugin) (PluginSendResult, error) {
+	result := PluginSendResult{NewSha256: c.Sha256}
+	// Create the interval folder if not exists
+	err := sftpClient.MkdirAll(node.GetPluginFolderFor(c))
+	if err != nil {
+		log.WithPlugin(node.Host, c.Name).Debugln("Error creating plugin folder:", err)
+		return result, err
+	}
+	pluginPath := node.GetPluginPath(c)
+	// Get the hash of the plugin file on the node, the last check state of the plugin is reused
+	state, err := StatPluginFile(sshClient, sftpClient, pluginPath, c, c)
+	if err != nil {
+		log.WithPlugin(node.Host, c.Name).Debugln("Error reading plugin file:", err)
+		return result, err
+	}
+	switch {
+	case state.Exists && state.Sha256 == c.Sha256:
+		result.Action = PluginUnchanged
+		result.OldSha256 = state.Sha256
+		log.WithPlugin(node.Host, c.Name).Debugln("Plugin", c.Name, "is actual on", node.Host)
+	case state.Exists:
+		// Save the replaced content for the rollback
+		result.Action = PluginReplaced
+		var content []byte
+		content, err = readRemoteFile(sftpClient, pluginPath)
+		if err == nil {
+			result.OldSha256 = Sha256Hex(content)
+			err = node.backupPlugin(sftpClient, c, content)
+		}
+	default:
+		// Backup of the earlier deploy is not a previous version of a new plugin
+		result.Action = PluginCreated
+		err = RemovePluginBackup(node.Host, c)
+	}
+	if err != nil {
+		log.WithPlugin(node.Host, c.Name).Debugln("Error saving plugin backup:", err)
+		return result, err
+	}
+	if result.Action != PluginUnchanged {
+		err = writePluginFile(sftpClient, pluginPath, c.ByteContent)
 		if err != nil {
-			log.Logger.Debugln("Error writing plugin file:", err)
-			return err
+			return result, err
+		}
+		log.WithPlugin(node.Host, c.Name).Debugln("Plugin", c.Name, result.Action, "on", node.Host)
+	}
+
+	// Remove copies of the plugin left in other interval folders
+	return result, node.cleanupPluginCopies(sftpClient, c)
+}
+
+// listArtifactFolders Return the base folder and all interval subfolders on the node
+// Not existing base folder returns an empty list
+func (node CheckMkNode) listArtifactFolders(sftpClient *sftp.Client, kind string) ([]string, error) {
+	baseFolder := node.GetBaseFolder(kind)
+	entries, err := sftpClient.ReadDir(baseFolder)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		log.Logger.Debugln("Error reading folder:", err)
+		return nil, err
+	}
+	folders := []string{baseFolder}
+	for _, entry := range entries {
+		// Interval folders have only digits in the name
+		if _, err := strconv.Atoi(entry.Name()); entry.IsDir() && err == nil {
+			folders = append(folders, fmt.Sprintf("%s/%s", baseFolder, entry.Name()))
+		}
+	}
+	return folders, nil
+}
+
+// removePluginFiles Remove the plugin from the base folder and interval subfolders except keepFolder
+func (node CheckMkNode) removePluginFiles(sftpClient *sftp.Client, c CheckMkPlugin, keepFolder string) error {
+	folders, err := node.listArtifactFolders(sftpClient, c.Kind)
+	if err != nil {
+		return err
+	}
+	for _, folder := range folders {
+		if folder == keepFolder {
+			continue
 		}
-		err = pluginFile.Close()
+		oldPath := fmt.Sprintf("%s/%s", folder, c.Name)
+		if _, err := sftpClient.Stat(oldPath); err != nil {
+			continue
+		}
+		err = sftpClient.Remove(oldPath)
 		if err != nil {
-			log.Logger.Debugln("Error closing plugin file:", err)
+			log.WithPlugin(node.Host, c.Name).Debugln("Error removing plugin file:", err)
 			return err
 		}
-		log.Logger.Debugln("Plugin", c.Name, "sent to", node.Host)
-		return nil
+		log.WithPlugin(node.Host, c.Name).Debugln("Plugin", c.Name, "removed from", folder, "on", node.Host)
 	}
-	log.Logger.Debugln("Plugin", c.Name, "is actual on", node.Host)
-
 	return nil
 }
 
+// cleanupPluginCopies Remove the plugin from the plugin folder and interval subfolders except the current one
+func (node CheckMkNode) cleanupPluginCopies(sftpClient *sftp.Client, c CheckMkPlugin) error {
+	return node.removePluginFiles(sftpClient, c, node.GetPluginFolderFor(c))
+}
+
+// CreateSftpClient Create the ssh and sftp clients for the node
+// Both clients must be closed by the caller
+func (node CheckMkNode) CreateSftpClient() (*ssh.Client, *sftp.Client, error) {
+	sshClient, err := node.CreateSshClient()
+	if err != nil {
+		log.WithNode(node.Host).Debugln("Error creating ssh client:", err)
+		return nil, nil, err
+	}
+	sftpClient, err := sftp.NewClient(sshClient)
+	if err != nil {
+		log.WithNode(node.Host).Debugln("Error creating sftp client:", err)
+		_ = sshClient.Close()
+		return nil, nil, err
+	}
+	return sshClient, sftpClient, nil
+}
+
+// withSftp Run the function with the sftp client of the node, the clients are closed after it
+func (node CheckMkNode) withSftp(run func(sftpClient *sftp.Client) error) error {
+	sshClient, sftpClient, err := node.CreateSftpClient()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = sftpClient.Close()
+		_ = sshClient.Close()
+	}()
+	return run(sftpClient)
+}
+
+// RemovePlugin Remove the plugin or local check from the base folder and all interval subfolders on the node
+func (node CheckMkNode) RemovePlugin(c CheckMkPlugin) error {
+	return node.withSftp(func(sftpClient *sftp.Client) error {
+		return node.removePluginFiles(sftpClient, c, "")
+	})
+}
+
+// FindUnmanagedPlugins Return files in the plugin or local folders which are not in the node lists
+// Files in interval subfolders are returned as <interval>/<name>
+// If RemoveUnmanagedPlugins is set in the config, the files are removed from the node
+func (node CheckMkNode) FindUnmanagedPlugins(sftpClient *sftp.Client, kind string) ([]string, error) {
+	folders, err := node.listArtifactFolders(sftpClient, kind)
+	if err != nil {
+		return nil, err
+	}
+	var unmanaged []string
+	for _, folder := range folders {
+		entries, err := sftpClient.ReadDir(folder)
+		if err != nil {
+			log.WithNode(node.Host).Debugln("Error reading plugin folder:", err)
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || node.isBackupOf(kind, entry.Name()) {
+				continue
+			}
+			plugin := node.FindArtifact(kind, entry.Name())
+			if node.hasArtifact(kind, entry.Name()) && node.GetPluginFolderFor(plugin) == folder {
+				continue
+			}
+			filePath := fmt.Sprintf("%s/%s", folder, entry.Name())
+			if config.ConfigCmkGetter.RemoveUnmanagedPlugins {
+				err = sftpClient.Remove(filePath)
+				Audit.Add(AuditEntry{
+					Action: AuditRemoveUnmanaged,
+					Host:   node.Host,
+					Kind:   kind,
+					Name:   strings.TrimPrefix(filePath, node.GetBaseFolder(kind)+"/"),
+				}.WithError(err))
+				if err != nil {
+					log.WithNode(node.Host).Debugln("Error removing unmanaged plugin:", err)
+				} else {
+					log.WithNode(node.Host).Infoln("Unmanaged plugin", filePath, "removed on", node.Host)
+					continue
+				}
+			}
+			unmanaged = append(unmanaged, strings.TrimPrefix(filePath, node.GetBaseFolder(kind)+"/"))
+		}
+	}
+	return unmanaged, nil
+}
+
 // CheckPluginsBySSH Check the plugins on the nodes and set the status is actual or not
 func CheckPluginsBySSH(node CheckMkNode) (CheckMkNode, error) {
 	// Create the ssh client
 	sshClient, err := node.CreateSshClient()
 	if err != nil {
-		log.Logger.Debugln("Error creating ssh client:", err)
+		log.WithNode(node.Host).Debugln("Error creating ssh client:", err)
 		return CheckMkNode{}, err
 	}
 	defer func() {
 		err := sshClient.Close()
 		if err != nil {
-			log.Logger.Debugln("Error closing ssh client:", err)
+			log.WithNode(node.Host).Debugln("Error closing ssh client:", err)
 		}
 	}()
 	// Create the sftp client
 	sftpClient, err := sftp.NewClient(sshClient)
 	if err != nil {
-		log.Logger.Debugln("Error creating sftp client:", err)
+		log.WithNode(node.Host).Debugln("Error creating sftp client:", err)
 		return CheckMkNode{}, err
 	}
 	defer func() {
 		err := sftpClient.Close()
 		if err != nil {
-			log.Logger.Debugln("Error closing sftp client:", err)
+			log.WithNode(node.Host).Debugln("Error closing sftp client:", err)
 		}
 	}()
+	// Copy the lists to not change the node in the map
+	node.Plugins = node.CheckArtifacts(sshClient, sftpClient, node.Plugins)
+	node.LocalChecks = node.CheckArtifacts(sshClient, sftpClient, node.LocalChecks)
+	// Find files which are not managed by cmk_getter
+	node.UnmanagedPlugins, err = node.FindUnmanagedPlugins(sftpClient, KindPlugin)
+	if err != nil {
+		log.WithNode(node.Host).Debugln("Error finding unmanaged plugins:", err)
+	}
+	node.UnmanagedLocalChecks, err = node.FindUnmanagedPlugins(sftpClient, KindLocal)
+	if err != nil {
+		log.WithNode(node.Host).Debugln("Error finding unmanaged local checks:", err)
+	}
+	// Detect the installed agent version
+	node.AgentVersion, err = detectAgentVersion(sshClient)
+	if err != nil {
+		log.WithNode(node.Host).Debugln("Error detecting agent version:", err)
+	}
+	node.IsAgentActual = IsActualAgentVersion(node.AgentVersion)
+	return node, nil
+}
+
+// CheckArtifacts Compare the plugins or local checks with the files on the node
+// Return the copy of the list with the actual status
+// If the source or the file on the node can not be read, the previous state of the plugin is kept,
+// so an outage of the Check_MK server does not report every plugin as drifted
+func (node CheckMkNode) CheckArtifacts(sshClient *ssh.Client, sftpClient *sftp.Client, artifacts []CheckMkPlugin) []CheckMkPlugin {
+	checked := append([]CheckMkPlugin(nil), artifacts...)
 	// Iterate over the plugins
-	for _, plugin := range node.Plugins {
+	for i, plugin := range checked {
 		err := GetPlugin(&plugin)
-		if err != nil {
-			log.Logger.Debugln("Error getting plugin:", err)
-			plugin.IsActual = false
+		if errors.Is(err, ErrChecksumMismatch) {
+			// Source is read but must not be deployed
+			log.WithPlugin(node.Host, plugin.Name).Debugln("Error getting plugin:", err)
+			checked[i].IsActual = false
 			continue
 		}
-		// Find the plugin file on the node
-		pluginFile, err := sftpClient.Open(fmt.Sprintf("%s/%s", node.GetPluginFolder(), plugin.Name))
 		if err != nil {
-			log.Logger.Debugln("Error opening plugin file:", err)
-			plugin.IsActual = false
+			log.WithPlugin(node.Host, plugin.Name).Debugln("Error getting plugin, the previous state is kept:", err)
 			continue
 		}
-		// Convert *File object to []byte with reader and buffer
-		reader := bufio.NewReader(pluginFile)
-		buffer := bytes.NewBuffer(make([]byte, 0))
-		_, err = buffer.ReadFrom(reader)
+		// Get the hash of the plugin file in the interval folder on the node
+		state, err := StatPluginFile(sshClient, sftpClient, node.GetPluginPath(plugin), plugin, artifacts[i])
 		if err != nil {
-			log.Logger.Debugln("Error reading plugin file:", err)
-			plugin.IsActual = false
+			log.WithPlugin(node.Host, plugin.Name).Debugln("Error reading plugin file, the previous state is kept:", err)
 			continue
 		}
-		// Calculate the md5 hash of the plugin file on the node
-		hashSum := md5.Sum(buffer.Bytes())
-		// Encode the hash to a string
-		md5HashOnNode := fmt.Sprintf("%x", hashSum)
-		// Check if the md5 hash of the plugin file on the node is different
-		if md5HashOnNode != plugin.CalculateMd5() {
-			plugin.IsActual = false
-			log.Logger.Debugln("Plugin", plugin.Name, "is not actual on", node.Host)
+		checked[i].IsActual = false
+		checked[i].Sha256 = plugin.Sha256
+		checked[i].Md5 = plugin.Md5
+		checked[i].NodeSize = state.Size
+		checked[i].NodeModTime = state.ModTime
+		checked[i].NodeSha256 = state.Sha256
+		if !state.Exists {
+			log.WithPlugin(node.Host, plugin.Name).Debugln("Plugin", plugin.Name, "not found on", node.Host)
 			continue
 		}
-		plugin.IsActual = true
-		// Change plugin in the node plugins list
-		for i, nodePlugin := range node.Plugins {
-			if nodePlugin.Name == plugin.Name {
-				node.Plugins[i] = plugin
-			}
+		// Check if the sha256 hash of the plugin file on the node is different
+		if checked[i].NodeSha256 != checked[i].Sha256 {
+			log.WithPlugin(node.Host, plugin.Name).Debugln("Plugin", plugin.Name, "is not actual on", node.Host)
+			continue
 		}
+		checked[i].IsActual = true
 	}
-	return node, nil
+	for i := range checked {
+		checked[i].SetStatus()
+	}
+	return checked
 }
 
 // PluginChecker Check the plugins on the nodes and set the status is actual or not
@@ -296,14 +790,17 @@ func PluginChecker() {
 	var wg sync.WaitGroup
 	// Defer wait group
 	defer wg.Wait()
+	// Revalidate the plugin sources once for all nodes
+	PullPluginsGit()
+	PluginSources.NewCycle()
 
-	// Iterate over the nodes
-	for _, node := range CheckMkNodeMap.Nodes {
+	// Iterate over the copy of the nodes, the map is changed by the other goroutines
+	for _, node := range CheckMkNodeMap.List() {
 		// Check if the node is available
 		if !node.IsAvailable {
 			continue
 		}
-		log.Logger.Debugln("Check plugins on", node.Host)
+		log.WithNode(node.Host).Debugln("Check plugins on", node.Host)
 		// Add 1 to wait group
 		wg.Add(1)
 		// Run the check plugins by ssh in goroutine
@@ -311,9 +808,9 @@ func PluginChecker() {
 			// Defer wait group done
 			defer wg.Done()
 			// Check the plugins on the node
-			_, err := CheckPluginsBySSH(node)
+			checkedNode, err := CheckPluginsBySSH(node)
 			if err != nil {
-				log.Logger.Debugln("Error checking plugins by ssh:", err)
+				log.WithNode(node.Host).Debugln("Error checking plugins by ssh:", err)
 				return
 			}
 			// Update the node in the map
@@ -321,8 +818,17 @@ func PluginChecker() {
 			CheckMkNodeMap.Mutex.Lock()
 			// Defer unlock the map
 			defer CheckMkNodeMap.Mutex.Unlock()
-			// Update the node in the map
-			CheckMkNodeMap.Nodes[node.Host] = node
+			// Update only plugins, the availability may be changed by SSHStatusUpdater
+			current := CheckMkNodeMap.Nodes[node.Host]
+			publishPluginChanges(node.Host, current.Plugins, checkedNode.Plugins)
+			publishPluginChanges(node.Host, current.LocalChecks, checkedNode.LocalChecks)
+			current.Plugins = checkedNode.Plugins
+			current.LocalChecks = checkedNode.LocalChecks
+			current.UnmanagedPlugins = checkedNode.UnmanagedPlugins
+			current.UnmanagedLocalChecks = checkedNode.UnmanagedLocalChecks
+			current.AgentVersion = checkedNode.AgentVersion
+			current.IsAgentActual = checkedNode.IsAgentActual
+			CheckMkNodeMap.Nodes[node.Host] = current
 		}(node)
 	}
 }
@@ -335,7 +841,9 @@ func CheckPlugins() {
 		// Log info that the plugin checker is running
 		log.Logger.Infoln("Run plugin checker")
 		// Run the plugin checker
+		Health.Start(SubsystemPluginChecker)
 		PluginChecker()
+		Health.Finish(SubsystemPluginChecker, nil)
 	}
 }
 
@@ -344,6 +852,6 @@ func PluginCheckerTicker() {
 	ticker := time.NewTicker(5 * time.Minute)
 	for {
 		<-ticker.C
-		PluginCheckerTrigger <- true
+		TriggerPluginChecker()
 	}
 }
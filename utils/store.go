@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"cmk_getter/config"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// storeMutex Lock for the state files in the data folder
+var storeMutex sync.Mutex
+
+// GetDataFolder Return folder for the state files of cmk_getter
+func GetDataFolder() string {
+	if config.ConfigCmkGetter.DataFolder == "" {
+		return "data"
+	}
+	return config.ConfigCmkGetter.DataFolder
+}
+
+// SaveState Save the value as JSON to <data folder>/<name>.json
+// The file is replaced atomically, so a crash does not leave a broken state
+func SaveState(name string, value interface{}) error {
+	content, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+	err = os.MkdirAll(GetDataFolder(), 0755)
+	if err != nil {
+		return err
+	}
+	statePath := filepath.Join(GetDataFolder(), name+".json")
+	tmpPath := statePath + ".tmp"
+	err = os.WriteFile(tmpPath, content, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, statePath)
+}
+
+// LoadState Load the value from <data folder>/<name>.json
+// Not existing state file is not an error and leaves the value unchanged
+func LoadState(name string, value interface{}) error {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+	content, err := os.ReadFile(filepath.Join(GetDataFolder(), name+".json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(content, value)
+}
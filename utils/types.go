@@ -12,7 +12,7 @@ var cmkSite = config.ConfigCmkGetter.Site
 var cmkDomain = config.ConfigCmkGetter.Domain
 
 const urlTemplate = "https://%s/%s/check_mk/api/1.0/%s"
-const downloadUrlTemplate = "check_mk/api/1.0/domain-types/agent/actions/download/invoke?os_type=linux_deb"
+const downloadUrlTemplate = "check_mk/api/1.0/domain-types/agent/actions/download/invoke?os_type=linux_%s"
 const hostConfigUrl = "check_mk/api/1.0/domain-types/host_config/collections/all"
 
 var CurrentVersion string = ""
@@ -90,12 +90,9 @@ type CmkHostConfigResponse struct {
 					PrivacyProtocol string `json:"privacy_protocol,omitempty"`
 					PrivacyPassword string `json:"privacy_password,omitempty"`
 				} `json:"snmp_community,omitempty"`
-				TagCheckMkAgentConn string `json:"tag_check_mk-agent-conn,omitempty"`
-				Labels              struct {
-					Purpose     string `json:"purpose,omitempty"`
-					CmkOsFamily string `json:"cmk/os_family,omitempty"`
-				} `json:"labels,omitempty"`
-				TagPiggyback string `json:"tag_piggyback,omitempty"`
+				TagCheckMkAgentConn string            `json:"tag_check_mk-agent-conn,omitempty"`
+				Labels              map[string]string `json:"labels,omitempty"`
+				TagPiggyback        string            `json:"tag_piggyback,omitempty"`
 			} `json:"attributes"`
 			EffectiveAttributes interface{} `json:"effective_attributes"`
 			IsCluster           bool        `json:"is_cluster"`
@@ -0,0 +1,211 @@
+package utils
+
+import (
+	"cmk_getter/config"
+	"cmk_getter/log"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Statuses of the plugins on the node
+const (
+	// PluginDeployed Plugin is actual and verification passed or was not run
+	PluginDeployed = "deployed"
+	// PluginFailing Plugin is actual but verification failed
+	PluginFailing = "failing"
+	// PluginDrifted Plugin is missing or different on the node
+	PluginDrifted = "drifted"
+)
+
+// maxVerificationOutput Max length of saved stdout and stderr of the plugin
+const maxVerificationOutput = 4096
+
+// PluginVerification Result of the plugin run on the node after the deploy
+type PluginVerification struct {
+	Time     time.Time `json:"time"`
+	Success  bool      `json:"success"`
+	ExitCode int       `json:"exit_code"`
+	Stdout   string    `json:"stdout"`
+	Stderr   string    `json:"stderr"`
+	Error    string    `json:"error,omitempty"`
+	// Previous version of the plugin was restored after the failed verification
+	RolledBack bool `json:"rolled_back,omitempty"`
+}
+
+// GetVerifyTimeout Return timeout of the plugin run for the verification
+func GetVerifyTimeout() time.Duration {
+	if config.ConfigCmkGetter.VerifyTimeout <= 0 {
+		return 60 * time.Second
+	}
+	return time.Duration(config.ConfigCmkGetter.VerifyTimeout) * time.Second
+}
+
+// SetStatus Set the status of the plugin by the actual flag and the verification
+func (c *CheckMkPlugin) SetStatus() {
+	switch {
+	case !c.IsActual:
+		c.Status = PluginDrifted
+	case c.Verification != nil && !c.Verification.Success:
+		c.Status = PluginFailing
+	default:
+		c.Status = PluginDeployed
+	}
+}
+
+// HasSection Check if the agent output has the <<<section>>> header
+// Headers with options like <<<section:sep(0)>>> are found too
+// Empty section matches any header
+func HasSection(output, section string) bool {
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "<<<") || !strings.HasSuffix(line, ">>>") {
+			continue
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(line, "<<<"), ">>>")
+		name = strings.SplitN(name, ":", 2)[0]
+		if section == "" || name == section {
+			return true
+		}
+	}
+	return false
+}
+
+// cropOutput Crop the output to maxVerificationOutput
+func cropOutput(output string) string {
+	if len(output) > maxVerificationOutput {
+		return output[:maxVerificationOutput]
+	}
+	return output
+}
+
+// VerifyPlugin Run the plugin on the node and check the output
+// Plugins must print the configured section header, local checks must print any line
+func (node CheckMkNode) VerifyPlugin(c CheckMkPlugin) PluginVerification {
+	result := PluginVerification{Time: time.Now(), ExitCode: -1}
+	sshClient, err := node.CreateSshClient()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer func() {
+		_ = sshClient.Close()
+	}()
+	stdout, stderr, exitCode, err := RunCommandTimeout(sshClient, node.GetPluginPath(c), GetVerifyTimeout())
+	result.Stdout = cropOutput(stdout)
+	result.Stderr = cropOutput(stderr)
+	result.ExitCode = exitCode
+	switch {
+	case err != nil:
+		result.Error = err.Error()
+	case exitCode != 0:
+		result.Error = fmt.Sprintf("exited with code %d", exitCode)
+	case c.Kind == KindLocal && strings.TrimSpace(stdout) == "":
+		result.Error = "no output"
+	case c.Kind != KindLocal && !HasSection(stdout, c.Section):
+		result.Error = fmt.Sprintf("no <<<%s>>> section in the output", c.Section)
+	default:
+		result.Success = true
+	}
+	return result
+}
+
+// recordDeploy Count the deploy in the metrics and save it to the history and the audit log
+func (node CheckMkNode) recordDeploy(ctx context.Context, c CheckMkPlugin, sent PluginSendResult, result, errorText string) {
+	kind := c.Kind
+	if kind == "" {
+		kind = KindPlugin
+	}
+	Metrics.ObserveDeploy(kind, result)
+	History.Add(HistoryEntry{
+		Event:  HistoryDeploy,
+		Host:   node.Host,
+		Kind:   kind,
+		Name:   c.Name,
+		Result: result,
+		Error:  errorText,
+	})
+	Audit.Add(AuditEntry{
+		Actor:     ActorFromContext(ctx),
+		Action:    AuditDeploy,
+		Host:      node.Host,
+		Kind:      kind,
+		Name:      c.Name,
+		OldSha256: sent.OldSha256,
+		NewSha256: sent.NewSha256,
+		Result:    result,
+		Error:     errorText,
+	})
+}
+
+// autoRollback Revert the failing plugin sent by the deploy and return true if the file was changed back
+// The plugin not changed by the deploy is kept, so the backup of an earlier deploy is never restored
+func (node CheckMkNode) autoRollback(c CheckMkPlugin, sent PluginSendResult, step StepLogger) bool {
+	if sent.Action == PluginUnchanged {
+		step("%s was not changed by the deploy, nothing to roll back", c.Name)
+		return false
+	}
+	step("Rolling back %s on %s", c.Name, node.Host)
+	reverted, err := node.RevertPlugin(c, sent)
+	entry := AuditEntry{
+		Actor:     AuditActorAuto,
+		Action:    AuditRollback,
+		Host:      node.Host,
+		Kind:      c.Kind,
+		Name:      c.Name,
+		OldSha256: sent.NewSha256,
+	}
+	if sent.Action == PluginReplaced {
+		entry.NewSha256 = sent.OldSha256
+	}
+	Audit.Add(entry.WithError(err))
+	if err != nil {
+		step("Error rolling back: %s", err)
+		log.WithPlugin(node.Host, c.Name).Infoln("Error rolling back plugin", c.Name, "on", node.Host+":", err)
+	}
+	return reverted
+}
+
+// DeployPlugin Send the plugin to the node and verify it
+// If the verification fails and AutoRollback is set, the replaced version is restored or the created plugin is removed
+// The verification is saved to the plugin of the node in the CheckMkNodeMap
+// The deploy is stopped before the next step if the context is cancelled
+func (node CheckMkNode) DeployPlugin(ctx context.Context, c CheckMkPlugin, step StepLogger) (PluginVerification, error) {
+	step("Sending %s %s to %s", c.Kind, c.Name, node.Host)
+	sent, err := node.SendPlugin(c)
+	if err != nil {
+		node.recordDeploy(ctx, c, sent, "failed", err.Error())
+		return PluginVerification{}, err
+	}
+	// The plugin is already on the node, the deploy is recorded without the verification
+	if ctx.Err() != nil {
+		node.recordDeploy(ctx, c, sent, "cancelled", ctx.Err().Error())
+		CheckMkNodeMap.UpdateNodePlugin(node.Host, c, func(plugin *CheckMkPlugin) {
+			plugin.IsActual = true
+			plugin.Verification = nil
+			plugin.SetStatus()
+		})
+		return PluginVerification{}, ctx.Err()
+	}
+	step("Verifying %s on %s", c.Name, node.Host)
+	verification := node.VerifyPlugin(c)
+	if verification.Success {
+		node.recordDeploy(ctx, c, sent, PluginDeployed, "")
+		step("Verification passed")
+	} else {
+		node.recordDeploy(ctx, c, sent, PluginFailing, verification.Error)
+		step("Verification failed: %s", verification.Error)
+		log.WithPlugin(node.Host, c.Name).Infoln("Plugin", c.Name, "deployed but failing on", node.Host+":", verification.Error)
+		if config.ConfigCmkGetter.AutoRollback {
+			verification.RolledBack = node.autoRollback(c, sent, step)
+		}
+	}
+	CheckMkNodeMap.UpdateNodePlugin(node.Host, c, func(plugin *CheckMkPlugin) {
+		// Rolled back or removed plugin is different from the source
+		plugin.IsActual = !verification.RolledBack
+		plugin.Verification = &verification
+		plugin.SetStatus()
+	})
+	return verification, nil
+}